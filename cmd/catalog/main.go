@@ -0,0 +1,55 @@
+// (C) Copyright 2022-2023 Hewlett Packard Enterprise Development LP
+
+// Package catalog contains ...
+package main
+
+import (
+	"context"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/catalog"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/opentracing"
+	logger "github.com/sirupsen/logrus"
+	"log"
+	"os"
+)
+
+/*
+package name    : catalog
+project         : qt-test-application
+*/
+
+const serviceName = "catalog-service"
+
+func main() {
+	// read the config from .env file
+	logger.SetFormatter(&logger.JSONFormatter{})
+	logger.SetReportCaller(true)
+	logger.SetLevel(logger.DebugLevel)
+	logger.SetOutput(os.Stdout)
+	logger.Infof("Server Starting...")
+
+	config, err := config.GetServiceConfigurations()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	// setup tracer
+	tp := opentracing.Init(config, serviceName)
+	defer func() {
+		if err := tp.Shutdown(context.Background()); err != nil {
+			log.Printf("Error shutting down tracer provider: %v", err)
+		}
+	}()
+
+	// setup meter
+	mp := opentracing.InitMeter(config, serviceName)
+	defer func() {
+		if err := mp.Shutdown(context.Background()); err != nil {
+			log.Printf("Error shutting down meter provider: %v", err)
+		}
+	}()
+
+	catalog.InitDB(config)
+	catalog.SetupServer(config)
+
+}
@@ -0,0 +1,79 @@
+// (C) Copyright 2022-2023 Hewlett Packard Enterprise Development LP
+
+// Package migrate contains ...
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+)
+
+/*
+package name    : migrate
+project         : qt-test-application
+*/
+
+const usage = "usage: migrate up | down [steps] | status"
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+
+	config, err := config.GetServiceConfigurations()
+	if err != nil {
+		log.Fatalf("failed to read configurations: %v", err)
+	}
+
+	m, err := datastore.NewMigrator(config)
+	if err != nil {
+		log.Fatalf("failed to initialize migrator: %v", err)
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	switch os.Args[1] {
+	case "up":
+		applied, err := m.Up(ctx)
+		if err != nil {
+			log.Fatalf("migrate up failed: %v", err)
+		}
+		for _, mig := range applied {
+			fmt.Printf("applied  %04d_%s\n", mig.Version, mig.Name)
+		}
+	case "down":
+		steps := 1
+		if len(os.Args) > 2 {
+			if steps, err = strconv.Atoi(os.Args[2]); err != nil || steps < 1 {
+				log.Fatal(usage)
+			}
+		}
+		reverted, err := m.Down(ctx, steps)
+		if err != nil {
+			log.Fatalf("migrate down failed: %v", err)
+		}
+		for _, mig := range reverted {
+			fmt.Printf("reverted %04d_%s\n", mig.Version, mig.Name)
+		}
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			log.Fatalf("migrate status failed: %v", err)
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+	default:
+		log.Fatal(usage)
+	}
+}
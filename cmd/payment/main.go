@@ -41,6 +41,15 @@ func main() {
 		}
 	}()
 
+	// setup meter
+	mp := opentracing.InitMeter(config, serviceName)
+	defer func() {
+		if err := mp.Shutdown(context.Background()); err != nil {
+			log.Printf("Error shutting down meter provider: %v", err)
+		}
+	}()
+
+	payment.InitDB(config)
 	payment.SetupServer(config)
 
 }
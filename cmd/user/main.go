@@ -59,7 +59,15 @@ func main() {
 		}
 	}()
 
-	// user.InitDB(config)
+	// setup meter
+	mp := opentracing.InitMeter(config, serviceName)
+	defer func() {
+		if err := mp.Shutdown(context.Background()); err != nil {
+			log.Printf("Error shutting down meter provider: %v", err)
+		}
+	}()
+
+	user.InitDB(config)
 	user.SetupServer(config)
 
 }
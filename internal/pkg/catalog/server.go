@@ -0,0 +1,371 @@
+// (C) Copyright 2022-2023 Hewlett Packard Enterprise Development LP
+
+// Package catalog contains the products that can be ordered, with their prices
+// and stock levels.
+package catalog
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/health"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/repository"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/utils"
+	"github.com/rs/cors"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+package name    : catalog
+project         : qt-test-application
+*/
+
+const serviceName = "catalog-service"
+
+var (
+	store  repository.Store
+	srv    *http.Server
+	tracer trace.Tracer
+	ready  health.Readiness
+)
+
+func SetupServer(cnf *config.ServiceConfigurations) {
+	tracer = otel.Tracer(serviceName)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/products", createProduct).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/products", listProducts).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/products/{productID}", getProduct).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/products/{productID}/stock", addStock).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/reservations", reserveStock).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/reservations/{orderID}", listReservations).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/reservations/{orderID}", releaseStock).Methods(http.MethodDelete, http.MethodOptions)
+	ready.Register(router)
+	router.Use(utils.LoggingMW)
+	router.Use(ready.Middleware)
+	router.Use(otelmux.Middleware(serviceName))
+	c := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete},
+	})
+
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+
+	srv = &http.Server{
+		Addr:    cnf.CatalogURL,
+		Handler: c.Handler(router),
+	}
+
+	log.Printf("Catalog service running at: %s", cnf.CatalogURL)
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to setup http catalog: %v", err)
+		}
+	}()
+
+	<-sigint
+	if err := srv.Shutdown(context.Background()); err != nil {
+		log.Printf("HTTP catalog shutdown failed")
+	}
+}
+
+// InitDB connects to the database in the background. Until it is connected,
+// the service reports not ready instead of exiting.
+func InitDB(cnf *config.ServiceConfigurations) {
+	go func() {
+		conn, err := datastore.New(cnf)
+		if err != nil {
+			log.Fatalf("failed to initialize db: %v", err)
+		}
+		store = repository.NewStore(conn)
+		ready.SetReady()
+	}()
+}
+
+type product struct {
+	ID    int64  `json:"id" validate:"-"`
+	Name  string `json:"name" validate:"required"`
+	Price int    `json:"price" validate:"required,gt=0"`
+	Stock int    `json:"stock" validate:"gte=0"`
+}
+
+func newProduct(p repository.Product) product {
+	return product{ID: p.ID, Name: p.Name, Price: p.Price, Stock: p.Stock}
+}
+
+type stockData struct {
+	// Quantity is added to the stock, or taken out of it if negative.
+	Quantity int `json:"quantity" validate:"required"`
+}
+
+type reservationData struct {
+	OrderID int64             `json:"order_id" validate:"required,gt=0"`
+	Items   []reservationItem `json:"items" validate:"required,min=1,dive"`
+}
+
+type reservationItem struct {
+	ProductID int64 `json:"product_id" validate:"required,gt=0"`
+	Quantity  int   `json:"quantity" validate:"required,gt=0"`
+}
+
+type reservation struct {
+	ID         int64      `json:"id"`
+	OrderID    int64      `json:"order_id"`
+	ProductID  int64      `json:"product_id"`
+	Quantity   int        `json:"quantity"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+}
+
+func newReservations(reservations []repository.StockReservation) []reservation {
+	response := make([]reservation, 0, len(reservations))
+	for _, res := range reservations {
+		r := reservation{ID: res.ID, OrderID: res.OrderID, ProductID: res.ProductID, Quantity: res.Quantity}
+		if !res.ReleasedAt.IsZero() {
+			r.ReleasedAt = &res.ReleasedAt
+		}
+		response = append(response, r)
+	}
+	return response
+}
+
+func createProduct(w http.ResponseWriter, r *http.Request) {
+	var p product
+	if err := utils.ReadBody(w, r, &p); err != nil {
+		return
+	}
+
+	ctx, span := tracer.Start(r.Context(), "create product")
+	defer span.End()
+
+	stored := repository.Product{Name: p.Name, Price: p.Price, Stock: p.Stock}
+	if err := store.Products().Create(ctx, &stored); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	span.SetAttributes(attribute.Int64("productID", stored.ID))
+
+	utils.WriteResponse(w, http.StatusCreated, newProduct(stored))
+}
+
+func getProduct(w http.ResponseWriter, r *http.Request) {
+	productID := mux.Vars(r)["productID"]
+
+	ctx, span := tracer.Start(r.Context(), "get product")
+	defer span.End()
+	span.SetAttributes(attribute.String("productID", productID))
+
+	id, err := parseID("product", productID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	stored, err := store.Products().Get(ctx, id)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	utils.WriteResponse(w, http.StatusOK, newProduct(stored))
+}
+
+// listProducts lists the products. The query parameters limit and cursor
+// select the page.
+func listProducts(w http.ResponseWriter, r *http.Request) {
+	page, err := datastore.ReadPage(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	ctx, span := tracer.Start(r.Context(), "list products")
+	defer span.End()
+
+	products, err := store.Products().List(ctx, page)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	response := datastore.PageResult[product]{Items: make([]product, 0, len(products.Items)), NextCursor: products.NextCursor}
+	for _, p := range products.Items {
+		response.Items = append(response.Items, newProduct(p))
+	}
+	utils.WriteResponse(w, http.StatusOK, response)
+}
+
+// addStock restocks a product, or writes some of its stock off.
+func addStock(w http.ResponseWriter, r *http.Request) {
+	var data stockData
+	if err := utils.ReadBody(w, r, &data); err != nil {
+		return
+	}
+
+	productID := mux.Vars(r)["productID"]
+	ctx, span := tracer.Start(r.Context(), "add product stock")
+	defer span.End()
+	span.SetAttributes(attribute.String("productID", productID), attribute.Int("quantity", data.Quantity))
+
+	id, err := parseID("product", productID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	var stored repository.Product
+	if err := store.WithTx(ctx, func(tx repository.Store) error {
+		if err := tx.Products().AddStock(ctx, id, data.Quantity); err != nil {
+			return err
+		}
+		stored, err = tx.Products().Get(ctx, id)
+		return err
+	}); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	utils.WriteResponse(w, http.StatusOK, newProduct(stored))
+}
+
+// reserveStock takes the items of an order out of stock, all or none of them.
+// An order is reserved once: reserving it again returns its reservations.
+func reserveStock(w http.ResponseWriter, r *http.Request) {
+	var data reservationData
+	if err := utils.ReadBody(w, r, &data); err != nil {
+		return
+	}
+
+	ctx, span := tracer.Start(r.Context(), "reserve stock")
+	defer span.End()
+	span.SetAttributes(attribute.Int64("orderID", data.OrderID))
+
+	// an order may hold a product in several items.
+	var (
+		productIDs []int64
+		quantities = map[int64]int{}
+	)
+	for _, item := range data.Items {
+		if _, ok := quantities[item.ProductID]; !ok {
+			productIDs = append(productIDs, item.ProductID)
+		}
+		quantities[item.ProductID] += item.Quantity
+	}
+
+	status := http.StatusCreated
+	var reservations []repository.StockReservation
+	if err := store.WithTx(ctx, func(tx repository.Store) error {
+		existing, err := tx.Reservations().ListByOrder(ctx, data.OrderID)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			status, reservations = http.StatusOK, existing
+			return nil
+		}
+
+		reservations = nil
+		for _, id := range productIDs {
+			if err := tx.Products().AddStock(ctx, id, -quantities[id]); err != nil {
+				return err
+			}
+			res := repository.StockReservation{OrderID: data.OrderID, ProductID: id, Quantity: quantities[id]}
+			if err := tx.Reservations().Create(ctx, &res); err != nil {
+				return err
+			}
+			reservations = append(reservations, res)
+		}
+		return nil
+	}); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	utils.WriteResponse(w, status, newReservations(reservations))
+}
+
+// listReservations lists the reservations of an order, released or not.
+func listReservations(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+
+	ctx, span := tracer.Start(r.Context(), "list reservations")
+	defer span.End()
+	span.SetAttributes(attribute.String("orderID", orderID))
+
+	id, err := parseID("order", orderID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	reservations, err := store.Reservations().ListByOrder(ctx, id)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	utils.WriteResponse(w, http.StatusOK, newReservations(reservations))
+}
+
+// releaseStock puts the items reserved for an order back in stock. Releasing
+// an order again, or an order with no reservation, changes nothing.
+func releaseStock(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+
+	ctx, span := tracer.Start(r.Context(), "release stock")
+	defer span.End()
+	span.SetAttributes(attribute.String("orderID", orderID))
+
+	id, err := parseID("order", orderID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	if err := store.WithTx(ctx, func(tx repository.Store) error {
+		reservations, err := tx.Reservations().ListByOrder(ctx, id)
+		if err != nil {
+			return err
+		}
+		for i := range reservations {
+			res := &reservations[i]
+			if !res.ReleasedAt.IsZero() {
+				continue
+			}
+			if err := tx.Reservations().Release(ctx, res); err != nil {
+				return err
+			}
+			if err := tx.Products().AddStock(ctx, res.ProductID, res.Quantity); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseID validates an ID parameter of a request.
+func parseID(kind, id string) (int64, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, gerrors.Newf(gerrors.BadRequest, "invalid %s id %q: must be a positive number", kind, id)
+	}
+	return n, nil
+}
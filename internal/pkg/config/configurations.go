@@ -4,6 +4,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
 )
@@ -18,20 +20,88 @@ type ServiceConfigurations struct {
 	UserURL      string `envconfig:"USER_URL" default:"localhost:8081"`
 	PaymentURL   string `envconfig:"PAYMENT_URL" default:"localhost:8082"`
 	OrderURL     string `envconfig:"ORDER_URL" default:"localhost:8083"`
+	CatalogURL   string `envconfig:"CATALOG_URL" default:"localhost:8084"`
+	DBDriver     string `envconfig:"DB_DRIVER" default:"mysql"`
 	SqlUser      string `envconfig:"SQL_USER" default:"root"`
 	SqlPassword  string `envconfig:"SQL_PASSWORD" default:"password"`
 	SqlHost      string `envconfig:"SQL_HOST" default:"localhost:3306"`
 	SqlDB        string `envconfig:"SQL_DB" default:"signoz"`
+	SqlSSLMode   string `envconfig:"SQL_SSL_MODE" default:"disable"`
+	SqlitePath   string `envconfig:"SQLITE_PATH" default:"signoz.db"`
 	Collector    string `envconfig:"OTEL_EXPORTER_OTLP_ENDPOINT" default:"localhost:4317"`
 	InsecureMode string `envconfig:"INSECURE_MODE" default:"true"`
 
+	SqlMaxOpenConns    int           `envconfig:"SQL_MAX_OPEN_CONNS" default:"25"`
+	SqlMaxIdleConns    int           `envconfig:"SQL_MAX_IDLE_CONNS" default:"25"`
+	SqlConnMaxLifetime time.Duration `envconfig:"SQL_CONN_MAX_LIFETIME" default:"5m"`
+	SqlConnMaxIdleTime time.Duration `envconfig:"SQL_CONN_MAX_IDLE_TIME" default:"1m"`
+	SqlStmtCacheSize   int           `envconfig:"SQL_STMT_CACHE_SIZE" default:"100"`
+
+	SqlConnectInitialInterval time.Duration `envconfig:"SQL_CONNECT_INITIAL_INTERVAL" default:"500ms"`
+	SqlConnectMaxInterval     time.Duration `envconfig:"SQL_CONNECT_MAX_INTERVAL" default:"10s"`
+	SqlConnectTimeout         time.Duration `envconfig:"SQL_CONNECT_TIMEOUT" default:"2m"`
+
+	// read replicas of SqlHost, for the mysql and postgres drivers.
+	SqlReplicaHosts         []string      `envconfig:"SQL_REPLICA_HOSTS"`
+	SqlReplicaCheckInterval time.Duration `envconfig:"SQL_REPLICA_CHECK_INTERVAL" default:"10s"`
+
+	// an instance placing an order holds the lease of its saga for SagaLease
+	// per step. The placements whose lease expired, e.g. by a crash, are
+	// resumed every SagaResumeInterval.
+	SagaResumeInterval time.Duration `envconfig:"SAGA_RESUME_INTERVAL" default:"30s"`
+	SagaLease          time.Duration `envconfig:"SAGA_LEASE" default:"30s"`
+
+	// payment gateway of the payment service. The fake one declines, times
+	// out or delays the settlement of the payments with the matching card
+	// token, or with an amount over the matching threshold (0 for none).
+	PaymentGateway         string        `envconfig:"PAYMENT_GATEWAY" default:"fake"`
+	GatewayLatency         time.Duration `envconfig:"GATEWAY_LATENCY" default:"0s"`
+	GatewayTimeout         time.Duration `envconfig:"GATEWAY_TIMEOUT" default:"5s"`
+	GatewaySettlementDelay time.Duration `envconfig:"GATEWAY_SETTLEMENT_DELAY" default:"2s"`
+	GatewayDeclineOver     int           `envconfig:"GATEWAY_DECLINE_OVER" default:"0"`
+	GatewayTimeoutOver     int           `envconfig:"GATEWAY_TIMEOUT_OVER" default:"0"`
+	GatewayDelayOver       int           `envconfig:"GATEWAY_DELAY_OVER" default:"0"`
+
+	// payments left pending for PaymentStaleAfter, e.g. if the user service did
+	// not answer, are reconciled every PaymentReconcileInterval.
+	PaymentReconcileInterval time.Duration `envconfig:"PAYMENT_RECONCILE_INTERVAL" default:"30s"`
+	PaymentStaleAfter        time.Duration `envconfig:"PAYMENT_STALE_AFTER" default:"1m"`
+
 	HeaderReadTimeout int
 }
 
+// RequestTimeout bounds the requests the services send to each other.
+const RequestTimeout = 10 * time.Second
+
 func GetServiceConfigurations() (serviceConf *ServiceConfigurations, err error) {
 	serviceConf = &ServiceConfigurations{}
 	if err = envconfig.Process("", serviceConf); err != nil {
 		return nil, gerrors.NewFromError(gerrors.ServiceSetup, err)
 	}
+	if err = serviceConf.validate(); err != nil {
+		return nil, err
+	}
 	return
 }
+
+// validate rejects the values envconfig accepts but the services cannot run with.
+func (c *ServiceConfigurations) validate() error {
+	if c.SqlReplicaCheckInterval <= 0 {
+		return gerrors.Newf(gerrors.ServiceSetup, "SQL_REPLICA_CHECK_INTERVAL must be positive, got %s", c.SqlReplicaCheckInterval)
+	}
+	if c.SagaResumeInterval <= 0 {
+		return gerrors.Newf(gerrors.ServiceSetup, "SAGA_RESUME_INTERVAL must be positive, got %s", c.SagaResumeInterval)
+	}
+	// a step sends one request to another service, within the lease.
+	if c.SagaLease <= RequestTimeout {
+		return gerrors.Newf(gerrors.ServiceSetup, "SAGA_LEASE must exceed the request timeout %s, got %s", RequestTimeout, c.SagaLease)
+	}
+	if c.PaymentReconcileInterval <= 0 {
+		return gerrors.Newf(gerrors.ServiceSetup, "PAYMENT_RECONCILE_INTERVAL must be positive, got %s", c.PaymentReconcileInterval)
+	}
+	// a payment is only reconciled once the requests that made it are over.
+	if c.PaymentStaleAfter <= RequestTimeout {
+		return gerrors.Newf(gerrors.ServiceSetup, "PAYMENT_STALE_AFTER must exceed the request timeout %s, got %s", RequestTimeout, c.PaymentStaleAfter)
+	}
+	return nil
+}
@@ -1,6 +1,28 @@
 package datastore
 
-import "context"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/XSAM/otelsql"
+	"github.com/cenkalti/backoff/v4"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/migrations"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+	DriverMemory   = "memory"
+)
 
 type InsertParams struct {
 	Query string
@@ -13,14 +35,165 @@ type SelectParams struct {
 	Result  []interface{}
 }
 
+// Scanner reads the columns of the current row, like *sql.Rows.
+type Scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+type SelectManyParams struct {
+	Query   string
+	Filters []interface{}
+	// Scan is called once per row, in order. Returning an error stops the iteration.
+	Scan func(Scanner) error
+}
+
 type UpdateParams struct {
 	Query string
 	Vars  []interface{}
+	// Conditional makes an update of no row fail with a gerrors.Conflict error,
+	// for updates guarded by a condition such as an expected VERSION.
+	Conditional bool
+}
+
+// Tx is the set of statements available inside a transaction started by DB.WithTx.
+type Tx interface {
+	InsertOne(context.Context, InsertParams) (int64, error)
+	SelectOne(context.Context, SelectParams) error
+	SelectMany(context.Context, SelectManyParams) error
+	UpdateOne(context.Context, UpdateParams) error
 }
 
 type DB interface {
 	InsertOne(context.Context, InsertParams) (int64, error)
 	SelectOne(context.Context, SelectParams) error
+	SelectMany(context.Context, SelectManyParams) error
 	UpdateOne(context.Context, UpdateParams) error
+	// WithTx runs fn in a transaction which is committed if fn returns nil and
+	// rolled back otherwise.
+	WithTx(context.Context, func(Tx) error) error
 	Close()
 }
+
+// New returns the DB implementation selected by configurations.DBDriver.
+func New(configurations *config.ServiceConfigurations) (DB, error) {
+	switch configurations.DBDriver {
+	case DriverMySQL:
+		return newMySQL(configurations)
+	case DriverPostgres:
+		return newPostgres(configurations)
+	case DriverSQLite:
+		return newSQLite(configurations)
+	case DriverMemory:
+		return newMemory(configurations)
+	default:
+		return nil, gerrors.Newf(gerrors.InvalidDBConfig, "unsupported db driver %q", configurations.DBDriver)
+	}
+}
+
+// IsConflict reports whether err is the conflict of a conditional update.
+func IsConflict(err error) bool {
+	var gerr gerrors.Gerror
+	return errors.As(err, &gerr) && gerr.EqualTag(gerrors.Conflict)
+}
+
+// RetryOnConflict runs fn until it does not fail with a conflict, at most
+// attempts times. fn must read the state it updates again on every call.
+func RetryOnConflict(ctx context.Context, attempts int, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(); !IsConflict(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// NewMigrator connects to the configured database and returns a Migrator for
+// its schema. The caller must Close it.
+func NewMigrator(configurations *config.ServiceConfigurations) (*migrations.Migrator, error) {
+	switch configurations.DBDriver {
+	case DriverMySQL:
+		db, err := openMySQL(configurations)
+		if err != nil {
+			return nil, err
+		}
+		return migrations.New(db, migrations.MySQL)
+	case DriverPostgres:
+		db, err := openPostgres(configurations)
+		if err != nil {
+			return nil, err
+		}
+		return migrations.New(db, migrations.Postgres)
+	case DriverSQLite:
+		db, err := openSQLite(configurations)
+		if err != nil {
+			return nil, err
+		}
+		return migrations.New(db, migrations.SQLite)
+	case DriverMemory:
+		return nil, gerrors.New(gerrors.InvalidDBConfig, "the memory driver has a fixed schema and no migrations")
+	default:
+		return nil, gerrors.Newf(gerrors.InvalidDBConfig, "unsupported db driver %q", configurations.DBDriver)
+	}
+}
+
+// migrate applies the pending migrations of the given dialect.
+func migrate(db *sql.DB, dialectName string) error {
+	m, err := migrations.New(db, dialectName)
+	if err != nil {
+		return fmt.Errorf("migrations error: %w", err)
+	}
+	applied, err := m.Up(context.Background())
+	if err != nil {
+		return fmt.Errorf("apply migrations error: %w", err)
+	}
+	for _, mig := range applied {
+		log.Printf("Applied migration %d_%s\n", mig.Version, mig.Name)
+	}
+	return nil
+}
+
+// setupPool applies the configured connection pool limits to db and exports
+// its sql.DBStats as metrics through the global meter provider.
+func setupPool(db *sql.DB, configurations *config.ServiceConfigurations, attrs ...attribute.KeyValue) error {
+	db.SetMaxOpenConns(configurations.SqlMaxOpenConns)
+	db.SetMaxIdleConns(configurations.SqlMaxIdleConns)
+	db.SetConnMaxLifetime(configurations.SqlConnMaxLifetime)
+	db.SetConnMaxIdleTime(configurations.SqlConnMaxIdleTime)
+
+	if err := otelsql.RegisterDBStatsMetrics(db, otelsql.WithAttributes(attrs...)); err != nil {
+		return fmt.Errorf("register db stats metrics error: %w", err)
+	}
+	return nil
+}
+
+// retry runs op until it succeeds or ctx is done, backing off exponentially
+// with jitter between attempts and logging each failed attempt.
+func retry(ctx context.Context, configurations *config.ServiceConfigurations, name string, op func() error) error {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = configurations.SqlConnectInitialInterval
+	b.MaxInterval = configurations.SqlConnectMaxInterval
+	// the deadline is enforced by ctx, shared by all the steps of a connection.
+	b.MaxElapsedTime = 0
+
+	var (
+		attempt int
+		lastErr error
+	)
+	if err := backoff.RetryNotify(func() error {
+		attempt++
+		lastErr = op()
+		return lastErr
+	}, backoff.WithContext(b, ctx), func(err error, next time.Duration) {
+		log.Printf("%s attempt %d failed: %v. retrying in %s", name, attempt, err, next.Round(time.Millisecond))
+	}); err != nil {
+		if lastErr != nil {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, lastErr)
+		}
+		return err
+	}
+	return nil
+}
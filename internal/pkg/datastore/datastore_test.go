@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestWithTx(t *testing.T) {
+	for _, driver := range []string{DriverMemory, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			db, err := New(testConfig(t, driver))
+			if err != nil {
+				t.Fatalf("new db: %v", err)
+			}
+			defer db.Close()
+			testWithTx(t, db)
+		})
+	}
+}
+
+// testWithTx checks that the statements of a transaction of db are rolled
+// back if it fails and kept if it is committed. db must be empty.
+func testWithTx(t *testing.T, db DB) {
+	errRollback := errors.New("rollback")
+	ctx := context.Background()
+
+	insert := func(tx Tx, name string) (int64, error) {
+		return tx.InsertOne(ctx, InsertParams{
+			Query: `insert into USERS(USER_NAME, ACCOUNT) VALUES (?, ?)`,
+			Vars:  []interface{}{name, name},
+		})
+	}
+	exists := func(id int64) bool {
+		t.Helper()
+		var name string
+		err := db.SelectOne(ctx, SelectParams{
+			Query:   `select USER_NAME from USERS where ID = ?`,
+			Filters: []interface{}{id},
+			Result:  []interface{}{&name},
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			return false
+		}
+		if err != nil {
+			t.Fatalf("select user %d: %v", id, err)
+		}
+		return true
+	}
+
+	var (
+		rolledBack int64
+		err        error
+	)
+	err = db.WithTx(ctx, func(tx Tx) error {
+		if rolledBack, err = insert(tx, "rolled back"); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("got error %v, want %v", err, errRollback)
+	}
+	if exists(rolledBack) {
+		t.Errorf("user %d inserted by a rolled back transaction exists", rolledBack)
+	}
+
+	// a second statement failing, here on a unique index, rolls the
+	// first one back too.
+	reserve := InsertParams{
+		Query: `insert into STOCK_RESERVATIONS(ORDER_ID, PRODUCT_ID, QUANTITY) VALUES (?, ?, ?)`,
+		Vars:  []interface{}{1, 1, 2},
+	}
+	if _, err := db.InsertOne(ctx, reserve); err != nil {
+		t.Fatalf("insert reservation: %v", err)
+	}
+	var beforeFailure int64
+	err = db.WithTx(ctx, func(tx Tx) error {
+		if beforeFailure, err = insert(tx, "before failure"); err != nil {
+			return err
+		}
+		_, err := tx.InsertOne(ctx, reserve)
+		return err
+	})
+	if err == nil {
+		t.Fatal("insert duplicate reservation: got no error")
+	}
+	if beforeFailure == 0 || exists(beforeFailure) {
+		t.Errorf("user %d inserted before a failed statement exists", beforeFailure)
+	}
+
+	var committed int64
+	if err := db.WithTx(ctx, func(tx Tx) error {
+		committed, err = insert(tx, "committed")
+		return err
+	}); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if !exists(committed) {
+		t.Errorf("user %d inserted by a committed transaction does not exist", committed)
+	}
+}
@@ -0,0 +1,656 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/XSAM/otelsql"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// memoryDriverName is the database/sql driver backed by memoryEngine. Going
+// through database/sql keeps the in-memory backend behind the same sqlDB
+// implementation, and therefore the same otelsql tracing, as MySQL.
+const memoryDriverName = "qt-memory"
+
+type memoryColumn struct {
+	name string
+	def  driver.Value
+}
+
+type memoryTableDef struct {
+	name    string
+	columns []memoryColumn
+	// unique lists the columns of the unique indexes of the table, besides ID.
+	unique [][]string
+}
+
+// memorySchema mirrors the SQL tables, unique indexes included. Every table
+// has an auto increment ID column. TestMemorySchemaMatchesMigrations checks it
+// against the migrations.
+var memorySchema = []memoryTableDef{
+	{name: "USERS", columns: []memoryColumn{
+		{name: "ID"},
+		{name: "USER_NAME"},
+		{name: "ACCOUNT"},
+		{name: "AMOUNT", def: int64(0)},
+		{name: "VERSION", def: int64(0)},
+		{name: "DELETED_AT"},
+	}},
+	{name: "ORDERS", columns: []memoryColumn{
+		{name: "ID"},
+		{name: "ACCOUNT"},
+		{name: "PRODUCT_NAME"},
+		{name: "PRICE"},
+		{name: "ORDER_STATUS"},
+		{name: "USER_ID"},
+		{name: "CREATED_AT"},
+	}},
+	{name: "LEDGER_ENTRIES", columns: []memoryColumn{
+		{name: "ID"},
+		{name: "USER_ID", def: int64(0)},
+		{name: "ACCOUNT"},
+		{name: "AMOUNT"},
+		{name: "REASON"},
+		{name: "ORDER_ID"},
+		{name: "PAYMENT_ID"},
+		{name: "CREATED_AT"},
+	}},
+	{name: "ORDER_ITEMS", columns: []memoryColumn{
+		{name: "ID"},
+		{name: "ORDER_ID"},
+		{name: "PRODUCT_ID"},
+		{name: "PRODUCT_NAME"},
+		{name: "UNIT_PRICE"},
+		{name: "QUANTITY"},
+	}},
+	{name: "PRODUCTS", columns: []memoryColumn{
+		{name: "ID"},
+		{name: "NAME"},
+		{name: "PRICE"},
+		{name: "STOCK", def: int64(0)},
+	}},
+	{name: "STOCK_RESERVATIONS", columns: []memoryColumn{
+		{name: "ID"},
+		{name: "ORDER_ID"},
+		{name: "PRODUCT_ID"},
+		{name: "QUANTITY"},
+		{name: "RELEASED_AT"},
+	}, unique: [][]string{{"ORDER_ID", "PRODUCT_ID"}}},
+	{name: "SAGAS", columns: []memoryColumn{
+		{name: "ID"},
+		{name: "ORDER_ID"},
+		{name: "STEP"},
+		{name: "STATUS"},
+		{name: "ERROR"},
+		{name: "VERSION", def: int64(0)},
+		{name: "CREATED_AT"},
+		{name: "UPDATED_AT"},
+		{name: "LEASE_OWNER"},
+		{name: "LEASE_UNTIL"},
+	}},
+	{name: "PAYMENTS", columns: []memoryColumn{
+		{name: "ID"},
+		{name: "USER_ID"},
+		{name: "ORDER_ID"},
+		{name: "REASON"},
+		{name: "AMOUNT"},
+		{name: "DIRECTION"},
+		{name: "STATUS"},
+		{name: "ERROR"},
+		{name: "CREATED_AT"},
+		{name: "UPDATED_AT"},
+	}},
+}
+
+func init() {
+	sql.Register(memoryDriverName, &memoryDriver{engines: map[string]*memoryEngine{}})
+}
+
+type memoryTable struct {
+	def    memoryTableDef
+	rows   []memoryRow
+	nextID int64
+}
+
+func (t *memoryTable) hasColumn(name string) bool {
+	for _, c := range t.def.columns {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUnique fails if rows, the rows of t once a statement is applied, hold
+// the same values twice in the columns of a unique index. As in SQL, rows with
+// a NULL in these columns are not compared.
+func (t *memoryTable) checkUnique(rows []memoryRow) error {
+	for _, columns := range append([][]string{{"ID"}}, t.def.unique...) {
+		seen := make(map[string]bool, len(rows))
+		for _, row := range rows {
+			key, ok := uniqueKey(row, columns)
+			if !ok {
+				continue
+			}
+			if seen[key] {
+				return fmt.Errorf("unique constraint failed: %s(%s)", t.def.name, strings.Join(columns, ", "))
+			}
+			seen[key] = true
+		}
+	}
+	return nil
+}
+
+// uniqueKey returns the values of the columns of row as a map key, and false
+// if one of them is NULL.
+func uniqueKey(row memoryRow, columns []string) (string, bool) {
+	var b strings.Builder
+	for _, c := range columns {
+		v := row[c]
+		if v == nil {
+			return "", false
+		}
+		fmt.Fprintf(&b, "%T:%v\x00", v, v)
+	}
+	return b.String(), true
+}
+
+// memoryEngine holds the tables of one in-memory database. A single lock
+// serializes statements and transactions, which gives transactions
+// serializable isolation.
+type memoryEngine struct {
+	lock   chan struct{}
+	tables map[string]*memoryTable
+}
+
+func newMemoryEngine() *memoryEngine {
+	e := &memoryEngine{
+		lock:   make(chan struct{}, 1),
+		tables: map[string]*memoryTable{},
+	}
+	for _, def := range memorySchema {
+		e.tables[def.name] = &memoryTable{def: def}
+	}
+	return e
+}
+
+func (e *memoryEngine) acquire(ctx context.Context) error {
+	select {
+	case e.lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *memoryEngine) release() {
+	<-e.lock
+}
+
+// snapshot copies the table state so that a transaction can be rolled back.
+// Rows are never mutated in place, so copying the row slices is sufficient.
+func (e *memoryEngine) snapshot() map[string]memoryTable {
+	s := make(map[string]memoryTable, len(e.tables))
+	for name, t := range e.tables {
+		s[name] = memoryTable{def: t.def, rows: append([]memoryRow(nil), t.rows...), nextID: t.nextID}
+	}
+	return s
+}
+
+func (e *memoryEngine) restore(s map[string]memoryTable) {
+	for name, t := range s {
+		t := t
+		e.tables[name] = &t
+	}
+}
+
+func (e *memoryEngine) table(name string) (*memoryTable, error) {
+	t, ok := e.tables[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown table %s", name)
+	}
+	return t, nil
+}
+
+func (e *memoryEngine) exec(stmt *statement, args []driver.NamedValue) (driver.Result, error) {
+	t, err := e.table(stmt.table)
+	if err != nil {
+		return nil, err
+	}
+	switch stmt.kind {
+	case stmtInsert:
+		return e.insert(t, stmt, args)
+	case stmtUpdate:
+		return e.update(t, stmt, args)
+	case stmtDelete:
+		return e.delete(t, stmt, args)
+	}
+	return nil, errors.New("select statements must be queried")
+}
+
+func (e *memoryEngine) insert(t *memoryTable, stmt *statement, args []driver.NamedValue) (driver.Result, error) {
+	for _, col := range stmt.columns {
+		if !t.hasColumn(col) {
+			return nil, fmt.Errorf("unknown column %s in %s", col, t.def.name)
+		}
+	}
+
+	var (
+		res  memoryResult
+		rows []memoryRow
+	)
+	nextID := t.nextID
+	for _, values := range stmt.values {
+		row := make(memoryRow, len(t.def.columns))
+		for _, c := range t.def.columns {
+			row[c.name] = c.def
+		}
+		for i, col := range stmt.columns {
+			v, err := values[i].eval(&evalContext{row: memoryRow{}, args: args})
+			if err != nil {
+				return nil, err
+			}
+			row[col] = v
+		}
+
+		if id, ok := row["ID"].(int64); ok {
+			if id > nextID {
+				nextID = id
+			}
+		} else {
+			nextID++
+			row["ID"] = nextID
+		}
+		res.lastInsertID = row["ID"].(int64)
+		rows = append(rows, row)
+	}
+
+	all := append(append(make([]memoryRow, 0, len(t.rows)+len(rows)), t.rows...), rows...)
+	if err := t.checkUnique(all); err != nil {
+		return nil, err
+	}
+
+	t.rows = all
+	t.nextID = nextID
+	res.rowsAffected = int64(len(rows))
+	return res, nil
+}
+
+func (e *memoryEngine) update(t *memoryTable, stmt *statement, args []driver.NamedValue) (driver.Result, error) {
+	for _, a := range stmt.set {
+		if !t.hasColumn(a.column) {
+			return nil, fmt.Errorf("unknown column %s in %s", a.column, t.def.name)
+		}
+	}
+
+	var res memoryResult
+	updated := make([]memoryRow, len(t.rows))
+	for i, row := range t.rows {
+		c := &evalContext{row: row, args: args}
+		ok, err := matches(stmt.where, c)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			updated[i] = row
+			continue
+		}
+
+		next := make(memoryRow, len(row))
+		for k, v := range row {
+			next[k] = v
+		}
+		for _, a := range stmt.set {
+			v, err := a.value.eval(c)
+			if err != nil {
+				return nil, err
+			}
+			next[a.column] = v
+		}
+		updated[i] = next
+		res.rowsAffected++
+	}
+	if err := t.checkUnique(updated); err != nil {
+		return nil, err
+	}
+
+	t.rows = updated
+	return res, nil
+}
+
+func (e *memoryEngine) delete(t *memoryTable, stmt *statement, args []driver.NamedValue) (driver.Result, error) {
+	var (
+		res  memoryResult
+		kept []memoryRow
+	)
+	for _, row := range t.rows {
+		ok, err := matches(stmt.where, &evalContext{row: row, args: args})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res.rowsAffected++
+			continue
+		}
+		kept = append(kept, row)
+	}
+
+	t.rows = kept
+	return res, nil
+}
+
+func (e *memoryEngine) query(stmt *statement, args []driver.NamedValue) (driver.Rows, error) {
+	if stmt.kind != stmtSelect {
+		return nil, errors.New("only select statements can be queried")
+	}
+	t, err := e.table(stmt.table)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []memoryRow
+	for _, row := range t.rows {
+		ok, err := matches(stmt.where, &evalContext{row: row, args: args})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			selected = append(selected, row)
+		}
+	}
+
+	if len(stmt.orderBy) > 0 {
+		var sortErr error
+		sort.SliceStable(selected, func(i, j int) bool {
+			for _, term := range stmt.orderBy {
+				a, err := term.expr.eval(&evalContext{row: selected[i], args: args})
+				if err != nil {
+					sortErr = err
+					return false
+				}
+				b, err := term.expr.eval(&evalContext{row: selected[j], args: args})
+				if err != nil {
+					sortErr = err
+					return false
+				}
+				cmp, err := compareNullsFirst(a, b)
+				if err != nil {
+					sortErr = err
+					return false
+				}
+				if cmp != 0 {
+					return (cmp < 0) != term.desc
+				}
+			}
+			return false
+		})
+		if sortErr != nil {
+			return nil, sortErr
+		}
+	}
+
+	if stmt.limit != nil {
+		v, err := stmt.limit.eval(&evalContext{args: args})
+		if err != nil {
+			return nil, err
+		}
+		limit, ok := v.(int64)
+		if !ok || limit < 0 {
+			return nil, fmt.Errorf("invalid limit %v", v)
+		}
+		if int64(len(selected)) > limit {
+			selected = selected[:limit]
+		}
+	}
+
+	rows := &memoryRows{}
+	if stmt.star {
+		for _, c := range t.def.columns {
+			rows.columns = append(rows.columns, c.name)
+		}
+	} else {
+		rows.columns = stmt.names
+	}
+
+	for _, row := range selected {
+		values := make([]driver.Value, 0, len(rows.columns))
+		if stmt.star {
+			for _, c := range t.def.columns {
+				values = append(values, row[c.name])
+			}
+		} else {
+			for _, e := range stmt.results {
+				v, err := e.eval(&evalContext{row: row, args: args})
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+		}
+		rows.data = append(rows.data, values)
+	}
+	return rows, nil
+}
+
+func matches(where expr, c *evalContext) (bool, error) {
+	if where == nil {
+		return true, nil
+	}
+	v, err := where.eval(c)
+	if err != nil {
+		return false, err
+	}
+	return v != nil && truthy(v), nil
+}
+
+func compareNullsFirst(a, b driver.Value) (int, error) {
+	switch {
+	case a == nil && b == nil:
+		return 0, nil
+	case a == nil:
+		return -1, nil
+	case b == nil:
+		return 1, nil
+	}
+	return compareValues(a, b)
+}
+
+type memoryDriver struct {
+	mu      sync.Mutex
+	engines map[string]*memoryEngine
+}
+
+// Open returns a connection to the engine registered under name, creating it
+// on first use, so every connection of a pool sees the same tables.
+func (d *memoryDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.engines[name]
+	if !ok {
+		e = newMemoryEngine()
+		d.engines[name] = e
+	}
+	return &memoryConn{engine: e}, nil
+}
+
+type memoryConn struct {
+	engine *memoryEngine
+	tx     *memoryTx
+}
+
+func (c *memoryConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *memoryConn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	stmt, err := parseStatement(query)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryStmt{conn: c, stmt: stmt}, nil
+}
+
+func (c *memoryConn) Close() error {
+	if c.tx != nil {
+		return c.tx.Rollback()
+	}
+	return nil
+}
+
+func (c *memoryConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *memoryConn) BeginTx(ctx context.Context, _ driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("transaction already in progress")
+	}
+	if err := c.engine.acquire(ctx); err != nil {
+		return nil, err
+	}
+	c.tx = &memoryTx{conn: c, snapshot: c.engine.snapshot()}
+	return c.tx, nil
+}
+
+// run executes fn holding the engine lock, unless the connection is inside a
+// transaction which already holds it.
+func (c *memoryConn) run(ctx context.Context, fn func() error) error {
+	if c.tx != nil {
+		return fn()
+	}
+	if err := c.engine.acquire(ctx); err != nil {
+		return err
+	}
+	defer c.engine.release()
+	return fn()
+}
+
+type memoryTx struct {
+	conn     *memoryConn
+	snapshot map[string]memoryTable
+}
+
+func (tx *memoryTx) Commit() error {
+	tx.conn.tx = nil
+	tx.conn.engine.release()
+	return nil
+}
+
+func (tx *memoryTx) Rollback() error {
+	tx.conn.engine.restore(tx.snapshot)
+	tx.conn.tx = nil
+	tx.conn.engine.release()
+	return nil
+}
+
+type memoryStmt struct {
+	conn *memoryConn
+	stmt *statement
+}
+
+func (s *memoryStmt) Close() error {
+	return nil
+}
+
+func (s *memoryStmt) NumInput() int {
+	return s.stmt.numInput
+}
+
+func (s *memoryStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *memoryStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	err := s.conn.run(ctx, func() (err error) {
+		res, err = s.conn.engine.exec(s.stmt, args)
+		return err
+	})
+	return res, err
+}
+
+func (s *memoryStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *memoryStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	err := s.conn.run(ctx, func() (err error) {
+		rows, err = s.conn.engine.query(s.stmt, args)
+		return err
+	})
+	return rows, err
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+type memoryResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r memoryResult) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+func (r memoryResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type memoryRows struct {
+	columns []string
+	data    [][]driver.Value
+	pos     int
+}
+
+func (r *memoryRows) Columns() []string {
+	return r.columns
+}
+
+func (r *memoryRows) Close() error {
+	return nil
+}
+
+func (r *memoryRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.data) {
+		return io.EOF
+	}
+	copy(dest, r.data[r.pos])
+	r.pos++
+	return nil
+}
+
+func newMemory(configurations *config.ServiceConfigurations) (DB, error) {
+	// databases are shared per process by name, like SqlDB on a MySQL server.
+	db, err := otelsql.Open(memoryDriverName, configurations.SqlDB, otelsql.WithAttributes(
+		semconv.DBSystemOtherSQL,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("open memory db error: %w", err)
+	}
+
+	if err := setupPool(db, configurations, semconv.DBSystemOtherSQL); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Using in-memory %s DB\n", configurations.SqlDB)
+
+	return newSQLDB(db, mysqlDialect, configurations), nil
+}
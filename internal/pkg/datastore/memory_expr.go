@@ -0,0 +1,412 @@
+package datastore
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type memoryRow map[string]driver.Value
+
+type evalContext struct {
+	row  memoryRow
+	args []driver.NamedValue
+}
+
+type expr interface {
+	eval(*evalContext) (driver.Value, error)
+}
+
+type literalExpr struct {
+	value driver.Value
+}
+
+func (e literalExpr) eval(*evalContext) (driver.Value, error) {
+	return e.value, nil
+}
+
+type placeholderExpr struct {
+	ordinal int
+}
+
+func (e placeholderExpr) eval(c *evalContext) (driver.Value, error) {
+	for _, arg := range c.args {
+		if arg.Ordinal == e.ordinal {
+			return normalize(arg.Value), nil
+		}
+	}
+	return nil, fmt.Errorf("missing argument %d", e.ordinal)
+}
+
+type columnExpr struct {
+	name string
+}
+
+func (e columnExpr) eval(c *evalContext) (driver.Value, error) {
+	v, ok := c.row[e.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown column %s", e.name)
+	}
+	return v, nil
+}
+
+type arithExpr struct {
+	op          string
+	left, right expr
+}
+
+func (e arithExpr) eval(c *evalContext) (driver.Value, error) {
+	l, err := e.left.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.right.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+
+	li, lok := l.(int64)
+	ri, rok := r.(int64)
+	if lok && rok {
+		if e.op == "+" {
+			return li + ri, nil
+		}
+		return li - ri, nil
+	}
+
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot apply %s to %T and %T", e.op, l, r)
+	}
+	if e.op == "+" {
+		return lf + rf, nil
+	}
+	return lf - rf, nil
+}
+
+type compareExpr struct {
+	op          string
+	left, right expr
+}
+
+func (e compareExpr) eval(c *evalContext) (driver.Value, error) {
+	l, err := e.left.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.right.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+
+	cmp, err := compareValues(l, r)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "=":
+		return cmp == 0, nil
+	case "!=", "<>":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+type logicalExpr struct {
+	op          string
+	left, right expr
+}
+
+func (e logicalExpr) eval(c *evalContext) (driver.Value, error) {
+	l, err := e.left.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	if e.op == "AND" && l == false {
+		return false, nil
+	}
+	if e.op == "OR" && l == true {
+		return true, nil
+	}
+
+	r, err := e.right.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil || r == nil {
+		if e.op == "AND" && r == false {
+			return false, nil
+		}
+		if e.op == "OR" && r == true {
+			return true, nil
+		}
+		return nil, nil
+	}
+	return r, nil
+}
+
+type notExpr struct {
+	e expr
+}
+
+func (e notExpr) eval(c *evalContext) (driver.Value, error) {
+	v, err := e.e.eval(c)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+type isNullExpr struct {
+	e      expr
+	negate bool
+}
+
+func (e isNullExpr) eval(c *evalContext) (driver.Value, error) {
+	v, err := e.e.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	return (v == nil) != e.negate, nil
+}
+
+type likeExpr struct {
+	e, pattern expr
+	// escape is the optional ESCAPE character.
+	escape expr
+	negate bool
+}
+
+func (e likeExpr) eval(c *evalContext) (driver.Value, error) {
+	v, err := e.e.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	p, err := e.pattern.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil || p == nil {
+		return nil, nil
+	}
+	var escape rune
+	if e.escape != nil {
+		esc, err := e.escape.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		if r := []rune(asString(esc)); len(r) == 1 {
+			escape = r[0]
+		} else {
+			return nil, fmt.Errorf("ESCAPE must be a single character, got %q", asString(esc))
+		}
+	}
+	return matchLike(asString(v), asString(p), escape) != e.negate, nil
+}
+
+type inExpr struct {
+	e      expr
+	list   []expr
+	negate bool
+}
+
+func (e inExpr) eval(c *evalContext) (driver.Value, error) {
+	v, err := e.e.eval(c)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	for _, item := range e.list {
+		iv, err := item.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		if iv == nil {
+			continue
+		}
+		cmp, err := compareValues(v, iv)
+		if err != nil {
+			return nil, err
+		}
+		if cmp == 0 {
+			return !e.negate, nil
+		}
+	}
+	return e.negate, nil
+}
+
+type coalesceExpr struct {
+	args []expr
+}
+
+func (e coalesceExpr) eval(c *evalContext) (driver.Value, error) {
+	for _, arg := range e.args {
+		v, err := arg.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// normalize converts driver values to the representation stored in memory tables.
+func normalize(v driver.Value) driver.Value {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case time.Time:
+		return t.UTC()
+	}
+	return v
+}
+
+func truthy(v driver.Value) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case int64:
+		return t != 0
+	case float64:
+		return t != 0
+	}
+	return v != nil
+}
+
+func toFloat(v driver.Value) (float64, bool) {
+	switch t := v.(type) {
+	case int64:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+// toNumber is toFloat extended to numeric strings.
+func toNumber(v driver.Value) (float64, bool) {
+	if f, ok := toFloat(v); ok {
+		return f, true
+	}
+	s, ok := v.(string)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return f, err == nil
+}
+
+func asString(v driver.Value) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	}
+	return fmt.Sprint(v)
+}
+
+// compareValues orders two non-NULL values. Like MySQL, numbers compared with
+// strings are compared numerically, so string path parameters match int columns.
+func compareValues(l, r driver.Value) (int, error) {
+	_, lnum := toFloat(l)
+	_, rnum := toFloat(r)
+	lf, lok := toNumber(l)
+	rf, rok := toNumber(r)
+	if (lnum || rnum) && lok && rok {
+		switch {
+		case lf < rf:
+			return -1, nil
+		case lf > rf:
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	switch lt := l.(type) {
+	case string:
+		return strings.Compare(lt, asString(r)), nil
+	case []byte:
+		return bytes.Compare(lt, []byte(asString(r))), nil
+	case time.Time:
+		rt, ok := r.(time.Time)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", l, r)
+		}
+		switch {
+		case lt.Before(rt):
+			return -1, nil
+		case lt.After(rt):
+			return 1, nil
+		}
+		return 0, nil
+	case bool:
+		rb, ok := r.(bool)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %T with %T", l, r)
+		}
+		switch {
+		case lt == rb:
+			return 0, nil
+		case !lt:
+			return -1, nil
+		}
+		return 1, nil
+	}
+	return 0, fmt.Errorf("cannot compare %T with %T", l, r)
+}
+
+// matchLike implements the LIKE wildcards % and _. A non-zero escape makes
+// the character following it match literally.
+func matchLike(s, pattern string, escape rune) bool {
+	sr, pr := []rune(s), []rune(pattern)
+	var match func(i, j int) bool
+	match = func(i, j int) bool {
+		for j < len(pr) {
+			switch {
+			case escape != 0 && pr[j] == escape && j+1 < len(pr):
+				j++
+				if i >= len(sr) || sr[i] != pr[j] {
+					return false
+				}
+			case pr[j] == '%':
+				for k := i; k <= len(sr); k++ {
+					if match(k, j+1) {
+						return true
+					}
+				}
+				return false
+			case pr[j] == '_':
+				if i >= len(sr) {
+					return false
+				}
+			default:
+				if i >= len(sr) || sr[i] != pr[j] {
+					return false
+				}
+			}
+			i++
+			j++
+		}
+		return i == len(sr)
+	}
+	return match(0, 0)
+}
@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+// evalWhere evaluates the WHERE clause where on row, with args bound to its
+// placeholders.
+func evalWhere(t *testing.T, where string, row memoryRow, args ...driver.Value) driver.Value {
+	t.Helper()
+	stmt, err := parseStatement(`select ID from USERS where ` + where)
+	if err != nil {
+		t.Fatalf("parse %q: %v", where, err)
+	}
+	v, err := stmt.where.eval(&evalContext{row: row, args: namedValues(args)})
+	if err != nil {
+		t.Fatalf("eval %q: %v", where, err)
+	}
+	return v
+}
+
+func TestMemoryWhere(t *testing.T) {
+	row := memoryRow{"ID": int64(7), "USER_NAME": "alice", "ACCOUNT": "a_1%", "AMOUNT": int64(0), "DELETED_AT": nil}
+
+	for _, tc := range []struct {
+		where string
+		args  []driver.Value
+		// want is nil for SQL NULL.
+		want driver.Value
+	}{
+		{where: `ID = ?`, args: []driver.Value{int64(7)}, want: true},
+		{where: `ID = ?`, args: []driver.Value{"7"}, want: true},
+		{where: `ID <> 7`, want: false},
+		{where: `ID > 6 and ID <= 7`, want: true},
+		{where: `AMOUNT + 5 = ?`, args: []driver.Value{int64(5)}, want: true},
+
+		// AND binds tighter than OR.
+		{where: `ID = 1 or ID = 7 and USER_NAME = 'bob'`, want: false},
+		{where: `(ID = 1 or ID = 7) and USER_NAME = 'alice'`, want: true},
+		{where: `ID = 1 or USER_NAME = 'alice' and AMOUNT = 0`, want: true},
+		{where: `not ID = 7 or USER_NAME = 'alice'`, want: true},
+
+		// comparisons with NULL are NULL, AND and OR follow three-valued logic.
+		{where: `DELETED_AT = ?`, args: []driver.Value{nil}, want: nil},
+		{where: `DELETED_AT is null`, want: true},
+		{where: `DELETED_AT is not null`, want: false},
+		{where: `DELETED_AT = 1 and ID = 7`, want: nil},
+		{where: `DELETED_AT = 1 and ID = 1`, want: false},
+		{where: `DELETED_AT = 1 or ID = 7`, want: true},
+		{where: `DELETED_AT = 1 or ID = 1`, want: nil},
+		{where: `not DELETED_AT = 1`, want: nil},
+		{where: `coalesce(DELETED_AT, 0) = 0`, want: true},
+
+		// LIKE wildcards and their escaping.
+		{where: `USER_NAME like 'al%'`, want: true},
+		{where: `USER_NAME like '_lice'`, want: true},
+		{where: `USER_NAME like 'al'`, want: false},
+		{where: `USER_NAME not like '%z%'`, want: true},
+		{where: `ACCOUNT like 'a!_1!%' escape '!'`, want: true},
+		{where: `USER_NAME like 'a!_ice' escape '!'`, want: false},
+		{where: `ACCOUNT like ? escape '\'`, args: []driver.Value{`a\_%`}, want: true},
+		{where: `DELETED_AT like '%'`, want: nil},
+
+		{where: `ID in (1, ?, 9)`, args: []driver.Value{int64(7)}, want: true},
+		{where: `ID not in (1, 9)`, want: true},
+	} {
+		t.Run(tc.where, func(t *testing.T) {
+			if got := evalWhere(t, tc.where, row, tc.args...); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemoryParseErrors(t *testing.T) {
+	for _, query := range []string{
+		`select ID from`,
+		`select ID from USERS where`,
+		`select ID from USERS where ID not 7`,
+		`select ID from USERS where ID = (7`,
+		`select ID from USERS where USER_NAME = 'open`,
+		`select ID from USERS where LOWER(USER_NAME) = ?`,
+		`update USERS set where ID = ?`,
+	} {
+		if _, err := parseStatement(query); err == nil {
+			t.Errorf("parse %q: got no error", query)
+		}
+	}
+}
+
+func TestMatchLike(t *testing.T) {
+	for _, tc := range []struct {
+		s, pattern string
+		escape     rune
+		want       bool
+	}{
+		{s: "", pattern: "%", want: true},
+		{s: "", pattern: "_", want: false},
+		{s: "abc", pattern: "a%c", want: true},
+		{s: "abc", pattern: "%%", want: true},
+		{s: "abc", pattern: "a_", want: false},
+		{s: "a%c", pattern: `a\%c`, escape: '\\', want: true},
+		{s: "abc", pattern: `a\%c`, escape: '\\', want: false},
+		{s: `a\c`, pattern: `a\\c`, escape: '\\', want: true},
+		// without an escape character, the backslash is literal.
+		{s: `a\bc`, pattern: `a\%`, want: true},
+	} {
+		if got := matchLike(tc.s, tc.pattern, tc.escape); got != tc.want {
+			t.Errorf("matchLike(%q, %q, %q) = %t, want %t", tc.s, tc.pattern, tc.escape, got, tc.want)
+		}
+	}
+}
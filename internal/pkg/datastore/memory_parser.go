@@ -0,0 +1,647 @@
+package datastore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The memory driver understands the small subset of SQL the services issue:
+// INSERT ... VALUES, SELECT ... FROM ... WHERE ... ORDER BY ... LIMIT,
+// UPDATE ... SET ... WHERE and DELETE FROM ... WHERE.
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokNumber
+	tokString
+	tokPlaceholder
+	tokSymbol
+	tokEOF
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(query string) ([]token, error) {
+	var tokens []token
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '?':
+			tokens = append(tokens, token{tokPlaceholder, "?"})
+			i++
+		case r == '\'':
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string in %q", query)
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, token{tokString, sb.String()})
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, string(runes[start:i])})
+		case unicode.IsLetter(r) || r == '_' || r == '`':
+			if r == '`' {
+				i++
+			}
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, strings.ToUpper(string(runes[start:i]))})
+			if i < len(runes) && runes[i] == '`' {
+				i++
+			}
+		default:
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "<=", ">=", "!=", "<>":
+					tokens = append(tokens, token{tokSymbol, two})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("(),=<>+-*.;", r) {
+				return nil, fmt.Errorf("unexpected character %q in %q", r, query)
+			}
+			tokens = append(tokens, token{tokSymbol, string(r)})
+			i++
+		}
+	}
+	return append(tokens, token{tokEOF, ""}), nil
+}
+
+type statementKind int
+
+const (
+	stmtInsert statementKind = iota
+	stmtSelect
+	stmtUpdate
+	stmtDelete
+)
+
+type orderTerm struct {
+	expr expr
+	desc bool
+}
+
+type assignment struct {
+	column string
+	value  expr
+}
+
+type statement struct {
+	kind  statementKind
+	table string
+
+	// insert
+	columns []string
+	values  [][]expr
+
+	// select
+	star    bool
+	results []expr
+	names   []string
+	orderBy []orderTerm
+	limit   expr
+
+	// update
+	set []assignment
+
+	// select, update and delete
+	where expr
+
+	numInput int
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	params int
+}
+
+func parseStatement(query string) (*statement, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+
+	var stmt *statement
+	switch {
+	case p.acceptKeyword("INSERT"):
+		stmt, err = p.parseInsert()
+	case p.acceptKeyword("SELECT"):
+		stmt, err = p.parseSelect()
+	case p.acceptKeyword("UPDATE"):
+		stmt, err = p.parseUpdate()
+	case p.acceptKeyword("DELETE"):
+		stmt, err = p.parseDelete()
+	default:
+		return nil, fmt.Errorf("unsupported statement %q", query)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %q: %w", query, err)
+	}
+
+	p.acceptSymbol(";")
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("parse %q: unexpected %q", query, p.peek().text)
+	}
+	stmt.numInput = p.params
+	return stmt, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) acceptKeyword(kw string) bool {
+	if t := p.peek(); t.kind == tokIdent && t.text == kw {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptSymbol(sym string) bool {
+	if t := p.peek(); t.kind == tokSymbol && t.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.acceptKeyword(kw) {
+		return fmt.Errorf("expected %s, got %q", kw, p.peek().text)
+	}
+	return nil
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if !p.acceptSymbol(sym) {
+		return fmt.Errorf("expected %q, got %q", sym, p.peek().text)
+	}
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return "", fmt.Errorf("expected identifier, got %q", t.text)
+	}
+	return t.text, nil
+}
+
+// column parses an optionally table-qualified column name.
+func (p *parser) column() (string, error) {
+	name, err := p.ident()
+	if err != nil {
+		return "", err
+	}
+	if p.acceptSymbol(".") {
+		return p.ident()
+	}
+	return name, nil
+}
+
+func (p *parser) parseInsert() (*statement, error) {
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &statement{kind: stmtInsert, table: table}
+
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.column()
+		if err != nil {
+			return nil, err
+		}
+		stmt.columns = append(stmt.columns, col)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var row []expr
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, e)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		if len(row) != len(stmt.columns) {
+			return nil, fmt.Errorf("%d values for %d columns", len(row), len(stmt.columns))
+		}
+		stmt.values = append(stmt.values, row)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseSelect() (*statement, error) {
+	stmt := &statement{kind: stmtSelect}
+	if p.acceptSymbol("*") {
+		stmt.star = true
+	} else {
+		for {
+			start := p.pos
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.results = append(stmt.results, e)
+			stmt.names = append(stmt.names, p.text(start, p.pos))
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt.table = table
+
+	if p.acceptKeyword("WHERE") {
+		if stmt.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			term := orderTerm{expr: e}
+			if p.acceptKeyword("DESC") {
+				term.desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			stmt.orderBy = append(stmt.orderBy, term)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		if stmt.limit, err = p.parsePrimary(); err != nil {
+			return nil, err
+		}
+	}
+
+	// row locks are implicit: the memory engine serializes transactions.
+	if p.acceptKeyword("FOR") {
+		if err := p.expectKeyword("UPDATE"); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseUpdate() (*statement, error) {
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &statement{kind: stmtUpdate, table: table}
+
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.column()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.set = append(stmt.set, assignment{column: col, value: value})
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if p.acceptKeyword("WHERE") {
+		if stmt.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseDelete() (*statement, error) {
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &statement{kind: stmtDelete, table: table}
+
+	if p.acceptKeyword("WHERE") {
+		if stmt.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// text reconstructs the source of tokens[start:end], used as result column names.
+func (p *parser) text(start, end int) string {
+	parts := make([]string, 0, end-start)
+	for _, t := range p.tokens[start:end] {
+		parts = append(parts, t.text)
+	}
+	return strings.Join(parts, "")
+}
+
+func (p *parser) parseExpr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if p.acceptKeyword("NOT") {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (expr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind == tokSymbol {
+		switch t.text {
+		case "=", "!=", "<>", "<", "<=", ">", ">=":
+			p.next()
+			right, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			return compareExpr{op: t.text, left: left, right: right}, nil
+		}
+	}
+
+	if p.acceptKeyword("IS") {
+		negate := p.acceptKeyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return isNullExpr{e: left, negate: negate}, nil
+	}
+
+	negate := p.acceptKeyword("NOT")
+	switch {
+	case p.acceptKeyword("LIKE"):
+		pattern, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		var escape expr
+		if p.acceptKeyword("ESCAPE") {
+			if escape, err = p.parseAdditive(); err != nil {
+				return nil, err
+			}
+		}
+		return likeExpr{e: left, pattern: pattern, escape: escape, negate: negate}, nil
+	case p.acceptKeyword("IN"):
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var list []expr
+		for {
+			e, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, e)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return inExpr{e: left, list: list, negate: negate}, nil
+	case negate:
+		return nil, fmt.Errorf("expected LIKE or IN after NOT, got %q", p.peek().text)
+	}
+	return left, nil
+}
+
+func (p *parser) parseAdditive() (expr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokSymbol || (t.text != "+" && t.text != "-") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = arithExpr{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokPlaceholder:
+		p.params++
+		return placeholderExpr{ordinal: p.params}, nil
+	case tokNumber:
+		if strings.Contains(t.text, ".") {
+			f, err := strconv.ParseFloat(t.text, 64)
+			if err != nil {
+				return nil, err
+			}
+			return literalExpr{f}, nil
+		}
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return literalExpr{n}, nil
+	case tokString:
+		return literalExpr{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "NULL":
+			return literalExpr{nil}, nil
+		case "TRUE":
+			return literalExpr{true}, nil
+		case "FALSE":
+			return literalExpr{false}, nil
+		}
+		if p.acceptSymbol("(") {
+			return p.parseCall(t.text)
+		}
+		if p.acceptSymbol(".") {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			return columnExpr{col}, nil
+		}
+		return columnExpr{t.text}, nil
+	case tokSymbol:
+		switch t.text {
+		case "(":
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+			return e, nil
+		case "-":
+			e, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return arithExpr{op: "-", left: literalExpr{int64(0)}, right: e}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func (p *parser) parseCall(name string) (expr, error) {
+	var args []expr
+	if !p.acceptSymbol(")") {
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, e)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+	}
+	switch name {
+	case "COALESCE":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("COALESCE needs at least one argument")
+		}
+		return coalesceExpr{args}, nil
+	}
+	return nil, fmt.Errorf("unsupported function %s", name)
+}
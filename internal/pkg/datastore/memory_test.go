@@ -0,0 +1,249 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+)
+
+// testDBs numbers the databases of the tests, memory ones outlive the test.
+var testDBs int64
+
+// testConfig returns the default configuration for driver, with a database
+// of its own for the test.
+func testConfig(t testing.TB, driver string) *config.ServiceConfigurations {
+	t.Helper()
+	cnf, err := config.GetServiceConfigurations()
+	if err != nil {
+		t.Fatalf("get configurations: %v", err)
+	}
+	cnf.DBDriver = driver
+	cnf.SqlDB = fmt.Sprintf("%s-%d", t.Name(), atomic.AddInt64(&testDBs, 1))
+	cnf.SqlitePath = t.TempDir() + "/test.db"
+	return cnf
+}
+
+func TestMemoryUniqueIndex(t *testing.T) {
+	db, err := New(testConfig(t, DriverMemory))
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	insert := InsertParams{
+		Query: `insert into STOCK_RESERVATIONS(ORDER_ID, PRODUCT_ID, QUANTITY) VALUES (?, ?, ?)`,
+		Vars:  []interface{}{1, 1, 2},
+	}
+	if _, err := db.InsertOne(ctx, insert); err != nil {
+		t.Fatalf("insert reservation: %v", err)
+	}
+	if _, err := db.InsertOne(ctx, insert); err == nil {
+		t.Fatal("insert duplicate reservation: got no error")
+	}
+
+	other := InsertParams{
+		Query: `insert into STOCK_RESERVATIONS(ORDER_ID, PRODUCT_ID, QUANTITY) VALUES (?, ?, ?)`,
+		Vars:  []interface{}{1, 2, 2},
+	}
+	id, err := db.InsertOne(ctx, other)
+	if err != nil {
+		t.Fatalf("insert other reservation: %v", err)
+	}
+	if err := db.UpdateOne(ctx, UpdateParams{
+		Query: `update STOCK_RESERVATIONS set PRODUCT_ID = ? where ID = ?`,
+		Vars:  []interface{}{1, id},
+	}); err == nil {
+		t.Fatal("update to a duplicate reservation: got no error")
+	}
+
+	n := 0
+	if err := db.SelectMany(ctx, SelectManyParams{
+		Query:   `select ID from STOCK_RESERVATIONS where ORDER_ID = ? and PRODUCT_ID = ?`,
+		Filters: []interface{}{1, 1},
+		Scan: func(Scanner) error {
+			n++
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("list reservations: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("got %d reservations of order 1 and product 1, want 1", n)
+	}
+}
+
+func TestMemoryOrderByLimit(t *testing.T) {
+	db, err := New(testConfig(t, DriverMemory))
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, u := range []struct {
+		name   string
+		amount interface{}
+	}{{"b", 5}, {"a", nil}, {"c", 5}, {"d", 1}} {
+		if _, err := db.InsertOne(ctx, InsertParams{
+			Query: `insert into USERS(USER_NAME, ACCOUNT, AMOUNT) VALUES (?, ?, ?)`,
+			Vars:  []interface{}{u.name, u.name, u.amount},
+		}); err != nil {
+			t.Fatalf("insert user %s: %v", u.name, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query string
+		limit int
+		want  string
+	}{
+		// NULLs sort first, ties keep the order of the next term.
+		{query: `select USER_NAME from USERS order by AMOUNT, USER_NAME limit ?`, limit: 10, want: "adbc"},
+		{query: `select USER_NAME from USERS order by AMOUNT desc, USER_NAME limit ?`, limit: 10, want: "bcda"},
+		{query: `select USER_NAME from USERS order by AMOUNT desc, USER_NAME desc limit ?`, limit: 2, want: "cb"},
+		{query: `select USER_NAME from USERS where AMOUNT >= 1 order by ID limit ?`, limit: 10, want: "bcd"},
+		{query: `select USER_NAME from USERS order by ID limit ?`, limit: 0, want: ""},
+	} {
+		got := ""
+		if err := db.SelectMany(ctx, SelectManyParams{
+			Query:   tc.query,
+			Filters: []interface{}{tc.limit},
+			Scan: func(row Scanner) error {
+				var name string
+				if err := row.Scan(&name); err != nil {
+					return err
+				}
+				got += name
+				return nil
+			},
+		}); err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s limit %d: got %q, want %q", tc.query, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestMemoryConditionalUpdate(t *testing.T) {
+	db, err := New(testConfig(t, DriverMemory))
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	id, err := db.InsertOne(ctx, InsertParams{
+		Query: `insert into USERS(USER_NAME, ACCOUNT) VALUES (?, ?)`,
+		Vars:  []interface{}{"a", "a"},
+	})
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+
+	update := func(version int) error {
+		return db.UpdateOne(ctx, UpdateParams{
+			Query:       `update USERS set AMOUNT = AMOUNT + 1, VERSION = VERSION + 1 where ID = ? and VERSION = ?`,
+			Vars:        []interface{}{id, version},
+			Conditional: true,
+		})
+	}
+	if err := update(0); err != nil {
+		t.Fatalf("update at version 0: %v", err)
+	}
+	// the row is at version 1 now: the same update matches no row.
+	if err := update(0); !IsConflict(err) {
+		t.Fatalf("update at stale version 0: got %v, want a conflict", err)
+	}
+	if err := update(1); err != nil {
+		t.Fatalf("update at version 1: %v", err)
+	}
+
+	var amount, version int
+	if err := db.SelectOne(ctx, SelectParams{
+		Query:   `select AMOUNT, VERSION from USERS where ID = ?`,
+		Filters: []interface{}{id},
+		Result:  []interface{}{&amount, &version},
+	}); err != nil {
+		t.Fatalf("select user: %v", err)
+	}
+	if amount != 2 || version != 2 {
+		t.Errorf("got amount %d and version %d, want 2 and 2", amount, version)
+	}
+}
+
+// TestMemorySchemaMatchesMigrations checks memorySchema against the tables
+// and unique indexes the sqlite migrations create.
+func TestMemorySchemaMatchesMigrations(t *testing.T) {
+	cnf := testConfig(t, DriverSQLite)
+	db, err := New(cnf)
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	db.Close()
+
+	conn, err := sql.Open("sqlite", cnf.SqlitePath)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer conn.Close()
+
+	names := func(query string, args ...interface{}) []string {
+		t.Helper()
+		rows, err := conn.Query(query, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+			names = append(names, name)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	var tables []string
+	for _, def := range memorySchema {
+		tables = append(tables, def.name)
+
+		var columns []string
+		for _, c := range def.columns {
+			columns = append(columns, c.name)
+		}
+		sort.Strings(columns)
+		if got := names(`select name from pragma_table_info(?)`, def.name); !reflect.DeepEqual(columns, got) {
+			t.Errorf("columns of %s: memory has %v, migrations %v", def.name, columns, got)
+		}
+
+		var unique []string
+		for _, u := range def.unique {
+			unique = append(unique, strings.Join(u, ","))
+		}
+		sort.Strings(unique)
+		got := names(`select (select group_concat(name, ',') from pragma_index_info(l.name)) from pragma_index_list(?) l
+			where l."unique" = 1 and l.origin <> 'pk'`, def.name)
+		if !reflect.DeepEqual(unique, got) {
+			t.Errorf("unique indexes of %s: memory has %v, migrations %v", def.name, unique, got)
+		}
+	}
+	sort.Strings(tables)
+	if got := names(`select name from sqlite_master where type = 'table' and name <> 'SCHEMA_MIGRATIONS' and name not like 'sqlite!_%' escape '!'`); !reflect.DeepEqual(tables, got) {
+		t.Errorf("tables: memory has %v, migrations %v", tables, got)
+	}
+}
@@ -7,30 +7,58 @@ import (
 	"github.com/XSAM/otelsql"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/migrations"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"log"
 )
 
-const CREATE_USERS_TABLE = `CREATE TABLE IF NOT EXISTS USERS(
-	ID int primary key auto_increment,
-	USER_NAME text,
-	ACCOUNT text,
-	AMOUNT int default 0
-)`
-
-const CREATE_ORDERS_TABLE = `CREATE TABLE IF NOT EXISTS ORDERS(
-	ID int primary key auto_increment,
-	ACCOUNT text,
-	PRODUCT_NAME text,
-	PRICE int,
-	ORDER_STATUS text
-)`
+// dialect captures how a database system differs from MySQL behind sqlDB.
+type dialect struct {
+	// rebind rewrites the ? placeholders used in queries, if needed.
+	rebind func(query string) string
+	// returningID reads the ID of inserted rows with RETURNING ID instead of LastInsertId.
+	returningID bool
+}
+
+var mysqlDialect = dialect{}
 
 type sqlDB struct {
 	*sql.DB
+	dialect dialect
+	stmts   *stmtCache
+	// replicas serve the reads outside of transactions, if configured.
+	replicas *replicaSet
+}
+
+func newSQLDB(db *sql.DB, d dialect, configurations *config.ServiceConfigurations) sqlDB {
+	return sqlDB{DB: db, dialect: d, stmts: newStmtCache(db, configurations.SqlStmtCacheSize)}
 }
 
-func New(configurations *config.ServiceConfigurations) (DB, error) {
+func newMySQL(configurations *config.ServiceConfigurations) (DB, error) {
+	db, err := openMySQL(configurations)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db, migrations.MySQL); err != nil {
+		return nil, err
+	}
+
+	replicas, err := openReplicas(configurations, mysqlDialect, func(host string) (*sql.DB, error) {
+		return openMySQLReplica(configurations, host)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB := newSQLDB(db, mysqlDialect, configurations)
+	sqlDB.replicas = replicas
+	return sqlDB, nil
+}
+
+// openMySQL creates the configured database if needed and connects to it.
+func openMySQL(configurations *config.ServiceConfigurations) (*sql.DB, error) {
 
 	// open up our database connection.
 	db, err := otelsql.Open("mysql", datasourceName(configurations.SqlUser, configurations.SqlPassword, configurations.SqlHost, ""), otelsql.WithAttributes(
@@ -41,99 +69,295 @@ func New(configurations *config.ServiceConfigurations) (DB, error) {
 	}
 	defer db.Close()
 
+	// mysql may still be starting up: retry until the connection deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), configurations.SqlConnectTimeout)
+	defer cancel()
+
 	// create signoz db
-	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS " + configurations.SqlDB); err != nil {
+	if err := retry(ctx, configurations, "signoz db create", func() error {
+		_, err := db.ExecContext(ctx, "CREATE DATABASE IF NOT EXISTS "+configurations.SqlDB)
+		return err
+	}); err != nil {
 		return nil, fmt.Errorf("signoz db create error: %w", err)
 	}
 
 	// close the exising connection. db.Close() is idempotent. Hence, it is safe to close the db here.
 	db.Close()
 
+	attrs := nodeAttributes(semconv.DBSystemMySQL, configurations.SqlHost, rolePrimary)
 	db, err = otelsql.Open("mysql", datasourceName(configurations.SqlUser, configurations.SqlPassword, configurations.SqlHost, configurations.SqlDB), otelsql.WithAttributes(
-		semconv.DBSystemMySQL,
+		attrs...,
 	))
 	if err != nil {
 		return nil, fmt.Errorf("open signoz db error: %w", err)
 	}
 
-	if err := db.Ping(); err != nil {
+	if err := setupPool(db, configurations, attrs...); err != nil {
+		return nil, err
+	}
+
+	if err := retry(ctx, configurations, "ping", func() error { return db.PingContext(ctx) }); err != nil {
 		return nil, fmt.Errorf("ping error: %w", err)
 	}
 
 	log.Printf("Successfully connected to %s DB\n", configurations.SqlDB)
 
-	if err := createTables(db); err != nil {
-		return nil, fmt.Errorf("create tables error: %w", err)
+	return db, nil
+}
+
+// openMySQLReplica connects to the database of a replica, which is created and
+// migrated through the primary.
+func openMySQLReplica(configurations *config.ServiceConfigurations, host string) (*sql.DB, error) {
+	attrs := nodeAttributes(semconv.DBSystemMySQL, host, roleReplica)
+	db, err := otelsql.Open("mysql", datasourceName(configurations.SqlUser, configurations.SqlPassword, host, configurations.SqlDB), otelsql.WithAttributes(
+		attrs...,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setupPool(db, configurations, attrs...); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	return sqlDB{db}, nil
+	return db, nil
 }
 
 func (db sqlDB) Close() {
+	db.replicas.close()
+	db.stmts.close()
 	db.DB.Close()
 }
 
 func (db sqlDB) InsertOne(ctx context.Context, p InsertParams) (int64, error) {
-	stmt, err := db.PrepareContext(ctx, p.Query)
+	return insertOne(ctx, db, db.dialect, p)
+}
+
+// SelectOne reads from a replica, if there is a healthy one and ctx does not
+// require the primary, and falls back to the primary if it cannot be reached.
+func (db sqlDB) SelectOne(ctx context.Context, p SelectParams) error {
+	if r := db.replicas.pick(ctx); r != nil {
+		if err := selectOne(ctx, r.sqlDB, r.dialect, p); !r.failed(err) {
+			return err
+		}
+	}
+	return selectOne(ctx, db, db.dialect, p)
+}
+
+// SelectMany reads from a replica like SelectOne, as long as no row was
+// handed to p.Scan yet.
+func (db sqlDB) SelectMany(ctx context.Context, p SelectManyParams) error {
+	if r := db.replicas.pick(ctx); r != nil {
+		scanned := false
+		rp := p
+		rp.Scan = func(row Scanner) error {
+			scanned = true
+			return p.Scan(row)
+		}
+		if err := selectMany(ctx, r.sqlDB, r.dialect, rp); !r.failed(err) || scanned {
+			return err
+		}
+	}
+	return selectMany(ctx, db, db.dialect, p)
+}
+
+func (db sqlDB) UpdateOne(ctx context.Context, p UpdateParams) error {
+	return updateOne(ctx, db, db.dialect, p)
+}
+
+func (db sqlDB) WithTx(ctx context.Context, fn func(Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx error: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(sqlTx{Tx: tx, dialect: db.dialect, stmts: db.stmts}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Printf("rollback tx error: %v", rbErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx error: %w", err)
+	}
+
+	return nil
+}
+
+type sqlTx struct {
+	*sql.Tx
+	dialect dialect
+	stmts   *stmtCache
+}
+
+func (tx sqlTx) InsertOne(ctx context.Context, p InsertParams) (int64, error) {
+	return insertOne(ctx, tx, tx.dialect, p)
+}
+
+func (tx sqlTx) SelectOne(ctx context.Context, p SelectParams) error {
+	return selectOne(ctx, tx, tx.dialect, p)
+}
+
+func (tx sqlTx) SelectMany(ctx context.Context, p SelectManyParams) error {
+	return selectMany(ctx, tx, tx.dialect, p)
+}
+
+func (tx sqlTx) UpdateOne(ctx context.Context, p UpdateParams) error {
+	return updateOne(ctx, tx, tx.dialect, p)
+}
+
+func (d dialect) query(query string) string {
+	if d.rebind == nil {
+		return query
+	}
+	return d.rebind(query)
+}
+
+// preparer is implemented by sqlDB and sqlTx. The returned function must be
+// called with the outcome of using the statement once the caller is done.
+type preparer interface {
+	prepare(ctx context.Context, query string) (*sql.Stmt, func(error), error)
+}
+
+func (db sqlDB) prepare(ctx context.Context, query string) (*sql.Stmt, func(error), error) {
+	return db.stmts.get(ctx, query)
+}
+
+// prepare binds the cached statement to the transaction's connection. A
+// statement that is not cached yet is prepared on the DB and cached first,
+// unless the pool has no connection left: preparing it on the DB would then
+// wait for one while holding the transaction's, so it is prepared on the
+// transaction alone and cached in the background.
+func (tx sqlTx) prepare(ctx context.Context, query string) (*sql.Stmt, func(error), error) {
+	stmt, release, ok := tx.stmts.lookup(query)
+	if !ok && tx.stmts.canPrepare() {
+		var err error
+		if stmt, release, err = tx.stmts.get(ctx, query); err != nil {
+			return nil, nil, err
+		}
+		ok = true
+	}
+	if !ok {
+		txStmt, err := tx.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		tx.stmts.warm(query)
+		return txStmt, func(error) { txStmt.Close() }, nil
+	}
+
+	txStmt := tx.StmtContext(ctx, stmt)
+	return txStmt, func(err error) {
+		txStmt.Close()
+		release(err)
+	}, nil
+}
+
+func insertOne(ctx context.Context, db preparer, d dialect, p InsertParams) (id int64, err error) {
+	query := p.Query
+	if d.returningID {
+		query += " RETURNING ID"
+	}
+
+	stmt, release, err := db.prepare(ctx, d.query(query))
 	if err != nil {
 		return 0, fmt.Errorf("prepare query error: %w", err)
 	}
-	defer stmt.Close()
+	defer func() { release(err) }()
+
+	if d.returningID {
+		if err = stmt.QueryRowContext(ctx, p.Vars...).Scan(&id); err != nil {
+			return 0, fmt.Errorf("statement exec error: %w", err)
+		}
+		return id, nil
+	}
 
 	res, err := stmt.ExecContext(ctx, p.Vars...)
 	if err != nil {
 		return 0, fmt.Errorf("statement exec error: %w", err)
 	}
 
-	id, err := res.LastInsertId()
-	if err != nil {
+	if id, err = res.LastInsertId(); err != nil {
 		return 0, fmt.Errorf("find affected rows error: %w", err)
 	}
 
 	return id, nil
 }
 
-func (db sqlDB) SelectOne(ctx context.Context, p SelectParams) error {
-	stmt, err := db.PrepareContext(ctx, p.Query)
+func selectOne(ctx context.Context, db preparer, d dialect, p SelectParams) (err error) {
+	stmt, release, err := db.prepare(ctx, d.query(p.Query))
 	if err != nil {
 		return fmt.Errorf("prepare query error: %w", err)
 	}
-	defer stmt.Close()
+	defer func() { release(err) }()
 
 	row := stmt.QueryRowContext(ctx, p.Filters...)
-	if err := row.Scan(p.Result...); err != nil {
+	if err = row.Scan(p.Result...); err != nil {
 		return fmt.Errorf("row scan error: %w", err)
 	}
 
 	return nil
 }
 
-func (db sqlDB) UpdateOne(ctx context.Context, p UpdateParams) error {
-	stmt, err := db.PrepareContext(ctx, p.Query)
+func selectMany(ctx context.Context, db preparer, d dialect, p SelectManyParams) (err error) {
+	stmt, release, err := db.prepare(ctx, d.query(p.Query))
 	if err != nil {
 		return fmt.Errorf("prepare query error: %w", err)
 	}
-	defer stmt.Close()
+	defer func() { release(err) }()
 
-	if _, err = stmt.ExecContext(ctx, p.Vars...); err != nil {
-		return fmt.Errorf("statement exec error: %w", err)
+	rows, err := stmt.QueryContext(ctx, p.Filters...)
+	if err != nil {
+		return fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = p.Scan(rows); err != nil {
+			return fmt.Errorf("row scan error: %w", err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("rows error: %w", err)
 	}
 
 	return nil
 }
 
-func datasourceName(username, password, host, dbName string) string {
-	return fmt.Sprintf("%s:%s@tcp(%s)/%s", username, password, host, dbName)
-}
+func updateOne(ctx context.Context, db preparer, d dialect, p UpdateParams) (err error) {
+	stmt, release, err := db.prepare(ctx, d.query(p.Query))
+	if err != nil {
+		return fmt.Errorf("prepare query error: %w", err)
+	}
+	defer func() { release(err) }()
 
-func createTables(db *sql.DB) error {
-	if _, err := db.Exec(CREATE_USERS_TABLE); err != nil {
-		return fmt.Errorf("create user table error: %w", err)
+	res, err := stmt.ExecContext(ctx, p.Vars...)
+	if err != nil {
+		return fmt.Errorf("statement exec error: %w", err)
 	}
 
-	if _, err := db.Exec(CREATE_ORDERS_TABLE); err != nil {
-		return fmt.Errorf("create orders table error: %w", err)
+	if p.Conditional {
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("find affected rows error: %w", err)
+		}
+		if n == 0 {
+			return gerrors.New(gerrors.Conflict, "the row was modified concurrently, retry")
+		}
 	}
 
 	return nil
 }
+
+func datasourceName(username, password, host, dbName string) string {
+	return fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true", username, password, host, dbName)
+}
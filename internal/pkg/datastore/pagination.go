@@ -0,0 +1,124 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+)
+
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
+)
+
+// Cursor identifies the last row of a page for keyset pagination. Key holds
+// the value of the sort column when a list is not sorted by ID alone; ID
+// breaks ties between rows with the same Key.
+type Cursor struct {
+	ID  int64  `json:"id"`
+	Key string `json:"key,omitempty"`
+}
+
+// Page selects the rows following After, at most Limit of them. A list query
+// filters on the cursor, for example
+//
+//	select ... from ORDERS where ID > ? order by ID limit ?
+//
+// with After.ID and Fetch() as arguments, and passes what it read to Paginate.
+type Page struct {
+	Limit int
+	After *Cursor
+}
+
+// PageResult is the response of a list endpoint.
+type PageResult[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// NewPage validates a page request. A zero limit selects DefaultPageLimit and
+// an empty cursor the first page.
+func NewPage(limit int, cursor string) (Page, error) {
+	switch {
+	case limit == 0:
+		limit = DefaultPageLimit
+	case limit < 0 || limit > MaxPageLimit:
+		return Page{}, gerrors.Newf(gerrors.BadRequest, "limit must be between 1 and %d", MaxPageLimit)
+	}
+
+	p := Page{Limit: limit}
+	if cursor == "" {
+		return p, nil
+	}
+
+	after, err := DecodeCursor(cursor)
+	if err != nil {
+		return Page{}, err
+	}
+	p.After = &after
+	return p, nil
+}
+
+// Fetch is the number of rows to query: one more than Limit, which tells
+// Paginate whether another page follows.
+func (p Page) Fetch() int {
+	return p.Limit + 1
+}
+
+// AfterID is the ID of the cursor, or 0 on the first page.
+func (p Page) AfterID() int64 {
+	if p.After == nil {
+		return 0
+	}
+	return p.After.ID
+}
+
+// Paginate trims items read with Page.Fetch to the page and returns them with
+// the cursor of the next page, if there is one.
+func Paginate[T any](p Page, items []T, cursor func(T) Cursor) PageResult[T] {
+	if items == nil {
+		items = []T{}
+	}
+	if len(items) <= p.Limit {
+		return PageResult[T]{Items: items}
+	}
+
+	items = items[:p.Limit]
+	return PageResult[T]{Items: items, NextCursor: EncodeCursor(cursor(items[len(items)-1]))}
+}
+
+// EncodeCursor returns the opaque form of c handed out to clients.
+func EncodeCursor(c Cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses a cursor produced by EncodeCursor.
+func DecodeCursor(s string) (Cursor, error) {
+	var c Cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, gerrors.New(gerrors.BadRequest, "invalid cursor")
+	}
+	// a cursor points at a row, whose ID is positive.
+	if err := json.Unmarshal(b, &c); err != nil || c.ID <= 0 {
+		return Cursor{}, gerrors.New(gerrors.BadRequest, "invalid cursor")
+	}
+	return c, nil
+}
+
+// ReadPage reads the page of a list request from its limit and cursor query
+// parameters.
+func ReadPage(r *http.Request) (Page, error) {
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			return Page{}, gerrors.Newf(gerrors.BadRequest, "invalid limit %q", v)
+		}
+	}
+	return NewPage(limit, r.URL.Query().Get("cursor"))
+}
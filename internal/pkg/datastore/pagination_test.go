@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+)
+
+func isBadRequest(err error) bool {
+	var gerr gerrors.Gerror
+	return errors.As(err, &gerr) && gerr.EqualTag(gerrors.BadRequest)
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, c := range []Cursor{
+		{ID: 1},
+		{ID: 42, Key: "bob"},
+		{ID: 7, Key: `quotes " and / slashes + é`},
+	} {
+		s := EncodeCursor(c)
+		got, err := DecodeCursor(s)
+		if err != nil {
+			t.Errorf("DecodeCursor(EncodeCursor(%+v)) error: %v", c, err)
+			continue
+		}
+		if got != c {
+			t.Errorf("DecodeCursor(EncodeCursor(%+v)) = %+v", c, got)
+		}
+	}
+}
+
+func TestDecodeCursorMalformed(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	for _, tc := range []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"id":1}`))},
+		{"not json", encode("id=1")},
+		{"truncated json", encode(`{"id":1`)},
+		{"json array", encode(`[1]`)},
+		{"string id", encode(`{"id":"1"}`)},
+		{"no id", encode(`{}`)},
+		{"null", encode(`null`)},
+		{"negative id", encode(`{"id":-1}`)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if c, err := DecodeCursor(tc.cursor); !isBadRequest(err) {
+				t.Errorf("DecodeCursor(%q) = %+v, %v, want a bad request error", tc.cursor, c, err)
+			}
+		})
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		limit  int
+		cursor string
+		want   Page
+		bad    bool
+	}{
+		{name: "default limit", limit: 0, want: Page{Limit: DefaultPageLimit}},
+		{name: "min limit", limit: 1, want: Page{Limit: 1}},
+		{name: "max limit", limit: MaxPageLimit, want: Page{Limit: MaxPageLimit}},
+		{name: "limit above max", limit: MaxPageLimit + 1, bad: true},
+		{name: "negative limit", limit: -1, bad: true},
+		{name: "cursor", limit: 5, cursor: EncodeCursor(Cursor{ID: 3, Key: "c"}), want: Page{Limit: 5, After: &Cursor{ID: 3, Key: "c"}}},
+		{name: "malformed cursor", limit: 5, cursor: "!!!", bad: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NewPage(tc.limit, tc.cursor)
+			if tc.bad {
+				if !isBadRequest(err) {
+					t.Errorf("NewPage(%d, %q) = %+v, %v, want a bad request error", tc.limit, tc.cursor, got, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("NewPage(%d, %q) = %+v, %v, want %+v", tc.limit, tc.cursor, got, err, tc.want)
+			}
+			if got.Fetch() != tc.want.Limit+1 {
+				t.Errorf("Fetch() = %d, want %d", got.Fetch(), tc.want.Limit+1)
+			}
+		})
+	}
+}
+
+func TestReadPage(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  Page
+		bad   bool
+	}{
+		{query: "", want: Page{Limit: DefaultPageLimit}},
+		{query: "?limit=3", want: Page{Limit: 3}},
+		{query: "?limit=3&cursor=" + EncodeCursor(Cursor{ID: 9}), want: Page{Limit: 3, After: &Cursor{ID: 9}}},
+		{query: "?limit=abc", bad: true},
+		{query: "?limit=101", bad: true},
+		{query: "?cursor=abc", bad: true},
+	} {
+		got, err := ReadPage(httptest.NewRequest("GET", "/users"+tc.query, nil))
+		if tc.bad {
+			if !isBadRequest(err) {
+				t.Errorf("ReadPage(%q) = %+v, %v, want a bad request error", tc.query, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ReadPage(%q) = %+v, %v, want %+v", tc.query, got, err, tc.want)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	cursor := func(id int64) Cursor { return Cursor{ID: id} }
+	for _, tc := range []struct {
+		name  string
+		limit int
+		// items read with Fetch, i.e. at most limit+1 of them.
+		items      []int64
+		want       []int64
+		nextCursor string
+	}{
+		{name: "empty page", limit: 2, items: nil, want: []int64{}},
+		{name: "partial last page", limit: 3, items: []int64{1, 2}, want: []int64{1, 2}},
+		{name: "full last page", limit: 2, items: []int64{1, 2}, want: []int64{1, 2}},
+		{name: "more pages", limit: 2, items: []int64{1, 2, 3}, want: []int64{1, 2}, nextCursor: EncodeCursor(Cursor{ID: 2})},
+		{name: "limit one", limit: 1, items: []int64{5, 6}, want: []int64{5}, nextCursor: EncodeCursor(Cursor{ID: 5})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Paginate(Page{Limit: tc.limit}, tc.items, cursor)
+			if !reflect.DeepEqual(got.Items, tc.want) || got.NextCursor != tc.nextCursor {
+				t.Errorf("Paginate(limit %d, %v) = %+v, want items %v and next cursor %q", tc.limit, tc.items, got, tc.want, tc.nextCursor)
+			}
+		})
+	}
+}
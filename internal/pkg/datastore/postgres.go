@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"github.com/lib/pq"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/migrations"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+var postgresDialect = dialect{
+	rebind:      rebindDollar,
+	returningID: true,
+}
+
+func newPostgres(configurations *config.ServiceConfigurations) (DB, error) {
+	db, err := openPostgres(configurations)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db, migrations.Postgres); err != nil {
+		return nil, err
+	}
+
+	replicas, err := openReplicas(configurations, postgresDialect, func(host string) (*sql.DB, error) {
+		return openPostgresReplica(configurations, host)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB := newSQLDB(db, postgresDialect, configurations)
+	sqlDB.replicas = replicas
+	return sqlDB, nil
+}
+
+// openPostgres creates the configured database if needed and connects to it.
+func openPostgres(configurations *config.ServiceConfigurations) (*sql.DB, error) {
+
+	// open up the maintenance database, there is no connection without a database in postgres.
+	db, err := otelsql.Open("postgres", postgresDatasourceName(configurations, configurations.SqlHost, "postgres"), otelsql.WithAttributes(
+		semconv.DBSystemPostgreSQL,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("open main db error: %w", err)
+	}
+	defer db.Close()
+
+	// postgres may still be starting up: retry until the connection deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), configurations.SqlConnectTimeout)
+	defer cancel()
+
+	// create signoz db. postgres has no CREATE DATABASE IF NOT EXISTS.
+	if err := retry(ctx, configurations, "signoz db create", func() error {
+		var exists bool
+		if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)`, configurations.SqlDB).Scan(&exists); err != nil || exists {
+			return err
+		}
+		_, err := db.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(configurations.SqlDB))
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("signoz db create error: %w", err)
+	}
+
+	db.Close()
+
+	attrs := nodeAttributes(semconv.DBSystemPostgreSQL, configurations.SqlHost, rolePrimary)
+	db, err = otelsql.Open("postgres", postgresDatasourceName(configurations, configurations.SqlHost, configurations.SqlDB), otelsql.WithAttributes(
+		attrs...,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("open signoz db error: %w", err)
+	}
+
+	if err := setupPool(db, configurations, attrs...); err != nil {
+		return nil, err
+	}
+
+	if err := retry(ctx, configurations, "ping", func() error { return db.PingContext(ctx) }); err != nil {
+		return nil, fmt.Errorf("ping error: %w", err)
+	}
+
+	log.Printf("Successfully connected to %s DB\n", configurations.SqlDB)
+
+	return db, nil
+}
+
+// openPostgresReplica connects to the database of a replica, which is created
+// and migrated through the primary.
+func openPostgresReplica(configurations *config.ServiceConfigurations, host string) (*sql.DB, error) {
+	attrs := nodeAttributes(semconv.DBSystemPostgreSQL, host, roleReplica)
+	db, err := otelsql.Open("postgres", postgresDatasourceName(configurations, host, configurations.SqlDB), otelsql.WithAttributes(
+		attrs...,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setupPool(db, configurations, attrs...); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func postgresDatasourceName(configurations *config.ServiceConfigurations, host, dbName string) string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(configurations.SqlUser, configurations.SqlPassword),
+		Host:     host,
+		Path:     "/" + dbName,
+		RawQuery: url.Values{"sslmode": {configurations.SqlSSLMode}}.Encode(),
+	}
+	return u.String()
+}
+
+// rebindDollar replaces the ? placeholders of a query, outside of string
+// literals, with postgres' $1, $2, ...
+func rebindDollar(query string) string {
+	var (
+		sb       strings.Builder
+		n        int
+		inString bool
+	)
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,99 @@
+//go:build postgres
+
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/migrations"
+)
+
+// The tests of this file run against the postgres server configured by the
+// SQL_* environment variables, in a database of their own that is dropped
+// afterwards:
+//
+//	SQL_HOST=localhost:5432 SQL_USER=postgres SQL_PASSWORD=password \
+//		go test -tags postgres ./internal/pkg/datastore/
+
+// postgresTestConfig returns the configuration of a new database for the test.
+func postgresTestConfig(t *testing.T) *config.ServiceConfigurations {
+	t.Helper()
+	cnf := testConfig(t, DriverPostgres)
+	cnf.SqlDB = fmt.Sprintf("test_%d", time.Now().UnixNano())
+
+	t.Cleanup(func() {
+		db, err := sql.Open("postgres", postgresDatasourceName(cnf, cnf.SqlHost, "postgres"))
+		if err != nil {
+			t.Errorf("open maintenance db: %v", err)
+			return
+		}
+		defer db.Close()
+		if _, err := db.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(cnf.SqlDB)); err != nil {
+			t.Errorf("drop db %s: %v", cnf.SqlDB, err)
+		}
+	})
+	return cnf
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	cnf := postgresTestConfig(t)
+	db, err := New(cnf)
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	db.Close()
+
+	conn, err := openPostgres(cnf)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	m, err := migrations.New(conn, migrations.Postgres)
+	if err != nil {
+		t.Fatalf("new migrator: %v", err)
+	}
+	defer m.Close()
+	ctx := context.Background()
+
+	assertApplied := func(want bool) {
+		t.Helper()
+		status, err := m.Status(ctx)
+		if err != nil {
+			t.Fatalf("migrations status: %v", err)
+		}
+		for _, s := range status {
+			if applied := s.AppliedAt != nil; applied != want {
+				t.Errorf("migration %d_%s applied: got %t, want %t", s.Version, s.Name, applied, want)
+			}
+		}
+	}
+	assertApplied(true)
+
+	// the down migrations revert the schema, so that it can be applied again.
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("migrations status: %v", err)
+	}
+	if _, err := m.Down(ctx, len(status)); err != nil {
+		t.Fatalf("migrations down: %v", err)
+	}
+	assertApplied(false)
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("migrations up again: %v", err)
+	}
+	assertApplied(true)
+}
+
+func TestPostgresWithTx(t *testing.T) {
+	db, err := New(postgresTestConfig(t))
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	defer db.Close()
+	testWithTx(t, db)
+}
@@ -0,0 +1,48 @@
+package datastore
+
+import "testing"
+
+func TestRebindDollar(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "no placeholder",
+			query: `select ID from USERS`,
+			want:  `select ID from USERS`,
+		},
+		{
+			name:  "placeholders numbered in order",
+			query: `insert into USERS(USER_NAME, ACCOUNT) VALUES (?, ?)`,
+			want:  `insert into USERS(USER_NAME, ACCOUNT) VALUES ($1, $2)`,
+		},
+		{
+			name:  "repeated placeholders",
+			query: `select ID from ORDERS where USER_ID = ? or ? = 0 limit ?`,
+			want:  `select ID from ORDERS where USER_ID = $1 or $2 = 0 limit $3`,
+		},
+		{
+			name:  "placeholder in a string literal",
+			query: `select ID from USERS where USER_NAME = '?' and ID = ?`,
+			want:  `select ID from USERS where USER_NAME = '?' and ID = $1`,
+		},
+		{
+			name:  "escaped quote in a string literal",
+			query: `select ID from USERS where USER_NAME = 'it''s ?' and ID > ?`,
+			want:  `select ID from USERS where USER_NAME = 'it''s ?' and ID > $1`,
+		},
+		{
+			name:  "placeholders around string literals",
+			query: `update USERS set USER_NAME = ?, ACCOUNT = '?' where ID = ? and ACCOUNT <> 'a?b'`,
+			want:  `update USERS set USER_NAME = $1, ACCOUNT = '?' where ID = $2 and ACCOUNT <> 'a?b'`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rebindDollar(tc.query); got != tc.want {
+				t.Errorf("rebindDollar(%q) = %q, want %q", tc.query, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+)
+
+// nodeAttributes are set on the spans and metrics of the connections to host,
+// so that a trace shows which node served a query.
+func nodeAttributes(system attribute.KeyValue, host, role string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		system,
+		attribute.String("db.node", host),
+		attribute.String("db.role", role),
+	}
+}
+
+type primaryKey struct{}
+
+// WithPrimary returns a context whose reads go to the primary. Replicas apply
+// writes with a lag, so a request reading what it just wrote should use it.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	forced, _ := ctx.Value(primaryKey{}).(bool)
+	return forced
+}
+
+type replica struct {
+	sqlDB
+	host    string
+	healthy atomic.Bool
+}
+
+// replicaSet spreads reads over the healthy replicas in turn. A replica is
+// taken out when a query on it fails to connect or its health check fails,
+// and put back once its health check succeeds again.
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	interval time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// openReplicas connects to the configured replica hosts with open. A replica
+// that cannot be reached yet starts unhealthy instead of failing the service.
+func openReplicas(configurations *config.ServiceConfigurations, d dialect, open func(host string) (*sql.DB, error)) (*replicaSet, error) {
+	if len(configurations.SqlReplicaHosts) == 0 {
+		return nil, nil
+	}
+
+	rs := &replicaSet{interval: configurations.SqlReplicaCheckInterval, stop: make(chan struct{})}
+	for _, host := range configurations.SqlReplicaHosts {
+		db, err := open(host)
+		if err != nil {
+			rs.close()
+			return nil, fmt.Errorf("open replica %s error: %w", host, err)
+		}
+
+		r := &replica{sqlDB: newSQLDB(db, d, configurations), host: host}
+		rs.replicas = append(rs.replicas, r)
+		if rs.check(r); !r.healthy.Load() {
+			log.Printf("replica %s is not reachable yet", r.host)
+		}
+	}
+
+	rs.wg.Add(1)
+	go rs.healthCheck()
+
+	return rs, nil
+}
+
+// pick returns the next healthy replica, or nil to read from the primary.
+func (rs *replicaSet) pick(ctx context.Context) *replica {
+	if rs == nil || usePrimary(ctx) {
+		return nil
+	}
+
+	n := uint64(len(rs.replicas))
+	start := rs.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if r := rs.replicas[(start+i)%n]; r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// failed reports whether the query should be retried on the primary, taking
+// the replica out when err means it cannot be reached.
+func (r *replica) failed(err error) bool {
+	if !isConnError(err) {
+		return false
+	}
+	if r.healthy.CompareAndSwap(true, false) {
+		log.Printf("replica %s is down: %v", r.host, err)
+	}
+	return true
+}
+
+func (rs *replicaSet) healthCheck() {
+	defer rs.wg.Done()
+
+	ticker := time.NewTicker(rs.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+			for _, r := range rs.replicas {
+				rs.check(r)
+			}
+		}
+	}
+}
+
+func (rs *replicaSet) check(r *replica) {
+	ctx, cancel := context.WithTimeout(context.Background(), rs.interval)
+	defer cancel()
+
+	err := r.PingContext(ctx)
+	switch {
+	case err != nil && r.healthy.CompareAndSwap(true, false):
+		log.Printf("replica %s is down: %v", r.host, err)
+	case err == nil && r.healthy.CompareAndSwap(false, true):
+		log.Printf("replica %s is up", r.host)
+	}
+}
+
+func (rs *replicaSet) close() {
+	if rs == nil {
+		return
+	}
+
+	close(rs.stop)
+	rs.wg.Wait()
+	for _, r := range rs.replicas {
+		r.sqlDB.Close()
+	}
+}
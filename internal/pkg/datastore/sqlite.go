@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/XSAM/otelsql"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/migrations"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteMemory = ":memory:"
+
+// sqlite uses the same ? placeholders and LastInsertId as MySQL.
+var sqliteDialect = dialect{}
+
+func newSQLite(configurations *config.ServiceConfigurations) (DB, error) {
+	db, err := openSQLite(configurations)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db, migrations.SQLite); err != nil {
+		return nil, err
+	}
+
+	return newSQLDB(db, sqliteDialect, configurations), nil
+}
+
+// openSQLite opens the database file at SqlitePath, creating it if needed.
+func openSQLite(configurations *config.ServiceConfigurations) (*sql.DB, error) {
+	db, err := otelsql.Open("sqlite", sqliteDatasourceName(configurations.SqlitePath), otelsql.WithAttributes(
+		semconv.DBSystemSqlite,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite db error: %w", err)
+	}
+
+	if err := setupPool(db, configurations, semconv.DBSystemSqlite); err != nil {
+		return nil, err
+	}
+
+	// every connection to :memory: opens a new, empty database, and the
+	// database is gone once its connection is closed.
+	if configurations.SqlitePath == sqliteMemory {
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("ping error: %w", err)
+	}
+
+	log.Printf("Successfully connected to %s DB\n", configurations.SqlitePath)
+
+	return db, nil
+}
+
+// sqliteDatasourceName waits for locks held by other connections, possibly of
+// other services sharing the file, instead of failing with SQLITE_BUSY, and
+// lets readers run concurrently with a writer.
+func sqliteDatasourceName(path string) string {
+	pragmas := url.Values{"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)"}}
+	return "file:" + path + "?" + pragmas.Encode()
+}
@@ -0,0 +1,212 @@
+package datastore
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysql error returned when a cached statement refers to a changed table.
+const mysqlErrNeedReprepare = 1615
+
+// warmTimeout bounds the background preparation of a statement, see warm.
+const warmTimeout = 30 * time.Second
+
+// stmtCache keeps prepared statements by query text, so that a query is
+// prepared once instead of on every call. Above its capacity, the least
+// recently used statement is closed once no caller is using it anymore.
+type stmtCache struct {
+	db       *sql.DB
+	capacity int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// warming holds the queries being prepared by warm.
+	warming map[string]bool
+}
+
+type cachedStmt struct {
+	query   string
+	stmt    *sql.Stmt
+	refs    int
+	evicted bool
+}
+
+func newStmtCache(db *sql.DB, capacity int) *stmtCache {
+	return &stmtCache{
+		db:       db,
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		warming:  map[string]bool{},
+	}
+}
+
+// get returns the statement for query, preparing it if needed, with the
+// function the caller must call with the outcome once it is done with it.
+func (c *stmtCache) get(ctx context.Context, query string) (*sql.Stmt, func(error), error) {
+	if c.capacity <= 0 {
+		stmt, err := c.db.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		return stmt, func(error) { stmt.Close() }, nil
+	}
+
+	c.mu.Lock()
+	if e, ok := c.entries[query]; ok {
+		entry := c.acquire(e)
+		c.mu.Unlock()
+		return entry.stmt, c.releaseFunc(entry), nil
+	}
+	c.mu.Unlock()
+
+	// prepare without holding the lock, so other queries are not held up by a round-trip.
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[query]; ok {
+		// another caller prepared the same query meanwhile.
+		stmt.Close()
+		entry := c.acquire(e)
+		return entry.stmt, c.releaseFunc(entry), nil
+	}
+
+	entry := &cachedStmt{query: query, stmt: stmt, refs: 1}
+	c.entries[query] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		c.evict(c.lru.Back())
+	}
+	return stmt, c.releaseFunc(entry), nil
+}
+
+// lookup is get without preparing on a miss.
+func (c *stmtCache) lookup(query string) (*sql.Stmt, func(error), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[query]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := c.acquire(e)
+	return entry.stmt, c.releaseFunc(entry), true
+}
+
+// canPrepare reports whether c caches statements and the DB has a connection
+// to prepare one on without waiting.
+func (c *stmtCache) canPrepare() bool {
+	if c.capacity <= 0 {
+		return false
+	}
+	stats := c.db.Stats()
+	return stats.MaxOpenConnections <= 0 || stats.Idle > 0 || stats.OpenConnections < stats.MaxOpenConnections
+}
+
+// warm prepares the statement of query on the DB in the background and caches
+// it, once a connection is free.
+func (c *stmtCache) warm(query string) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[query]; ok || c.warming[query] {
+		return
+	}
+	c.warming[query] = true
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), warmTimeout)
+		defer cancel()
+		_, release, err := c.get(ctx, query)
+		if err == nil {
+			release(nil)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.warming, query)
+	}()
+}
+
+// acquire must be called with c.mu held.
+func (c *stmtCache) acquire(e *list.Element) *cachedStmt {
+	c.lru.MoveToFront(e)
+	entry := e.Value.(*cachedStmt)
+	entry.refs++
+	return entry
+}
+
+func (c *stmtCache) releaseFunc(entry *cachedStmt) func(error) {
+	return func(err error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if isStaleStmtError(err) {
+			if e, ok := c.entries[entry.query]; ok && e.Value == entry {
+				c.evict(e)
+			}
+		}
+
+		entry.refs--
+		if entry.evicted && entry.refs == 0 {
+			entry.stmt.Close()
+		}
+	}
+}
+
+// evict must be called with c.mu held.
+func (c *stmtCache) evict(e *list.Element) {
+	entry := c.lru.Remove(e).(*cachedStmt)
+	delete(c.entries, entry.query)
+	entry.evicted = true
+	if entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+// isStaleStmtError reports whether err means the statement should be prepared again.
+func isStaleStmtError(err error) bool {
+	if isConnError(err) {
+		return true
+	}
+
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrNeedReprepare
+}
+
+// isConnError reports whether err means the connection to the database failed.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func newTestStmtCache(t *testing.T, capacity int) *stmtCache {
+	t.Helper()
+	db, err := sql.Open(memoryDriverName, t.Name())
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	c := newStmtCache(db, capacity)
+	t.Cleanup(func() {
+		c.close()
+		db.Close()
+	})
+	return c
+}
+
+// use gets the statement of query from c and releases it with err.
+func use(t *testing.T, c *stmtCache, query string, err error) {
+	t.Helper()
+	_, release, getErr := c.get(context.Background(), query)
+	if getErr != nil {
+		t.Fatalf("get %q: %v", query, getErr)
+	}
+	release(err)
+}
+
+func assertCached(t *testing.T, c *stmtCache, want map[string]bool) {
+	t.Helper()
+	for query, cached := range want {
+		if _, ok := c.entries[query]; ok != cached {
+			t.Errorf("%q cached: got %t, want %t", query, ok, cached)
+		}
+	}
+}
+
+const (
+	queryUsers  = `select ID from USERS where ID = ?`
+	queryOrders = `select ID from ORDERS where ID = ?`
+	querySagas  = `select ID from SAGAS where ID = ?`
+)
+
+func TestStmtCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTestStmtCache(t, 2)
+
+	use(t, c, queryUsers, nil)
+	use(t, c, queryOrders, nil)
+	use(t, c, queryUsers, nil)
+	use(t, c, querySagas, nil)
+
+	assertCached(t, c, map[string]bool{queryUsers: true, queryOrders: false, querySagas: true})
+}
+
+func TestStmtCacheKeepsEvictedStatementInUse(t *testing.T) {
+	c := newTestStmtCache(t, 1)
+	ctx := context.Background()
+
+	stmt, release, err := c.get(ctx, queryUsers)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	use(t, c, queryOrders, nil)
+	assertCached(t, c, map[string]bool{queryUsers: false, queryOrders: true})
+
+	rows, err := stmt.QueryContext(ctx, 1)
+	if err != nil {
+		t.Fatalf("query evicted statement in use: %v", err)
+	}
+	rows.Close()
+
+	release(nil)
+	if _, err := stmt.QueryContext(ctx, 1); err == nil {
+		t.Error("query evicted statement once released: got no error")
+	}
+}
+
+func TestStmtCacheInvalidatesStaleStatement(t *testing.T) {
+	c := newTestStmtCache(t, 2)
+
+	use(t, c, queryUsers, nil)
+	use(t, c, queryOrders, sql.ErrNoRows)
+	assertCached(t, c, map[string]bool{queryUsers: true, queryOrders: true})
+
+	use(t, c, queryUsers, driver.ErrBadConn)
+	assertCached(t, c, map[string]bool{queryUsers: false, queryOrders: true})
+
+	// the next call prepares it again.
+	use(t, c, queryUsers, nil)
+	assertCached(t, c, map[string]bool{queryUsers: true})
+}
+
+// prepareInTx prepares query in a transaction of c's DB and releases it.
+func prepareInTx(t *testing.T, c *stmtCache, query string) {
+	t.Helper()
+	db := sqlDB{DB: c.db, stmts: c}
+	if err := db.WithTx(context.Background(), func(tx Tx) error {
+		_, release, err := tx.(sqlTx).prepare(context.Background(), query)
+		if err != nil {
+			return err
+		}
+		release(nil)
+		return nil
+	}); err != nil {
+		t.Fatalf("prepare %q in tx: %v", query, err)
+	}
+}
+
+func TestStmtCacheFilledByTx(t *testing.T) {
+	c := newTestStmtCache(t, 2)
+
+	prepareInTx(t, c, queryUsers)
+	assertCached(t, c, map[string]bool{queryUsers: true})
+}
+
+func TestStmtCacheWarmedAfterTxHoldingLastConn(t *testing.T) {
+	c := newTestStmtCache(t, 2)
+	c.db.SetMaxOpenConns(1)
+
+	prepareInTx(t, c, queryUsers)
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		_, cached := c.entries[queryUsers]
+		c.mu.Unlock()
+		if cached {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%q not cached after the tx ended", queryUsers)
+}
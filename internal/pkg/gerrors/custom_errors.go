@@ -22,4 +22,11 @@ const (
 
 	InvalidDBConfig ErrorCode = "Invalid DB Configurations"
 	InvalidInput    ErrorCode = "Bad Request"
+
+	Conflict            ErrorCode = "Conflict"
+	InsufficientBalance ErrorCode = "Insufficient Balance"
+	InvalidTransition   ErrorCode = "Invalid Transition"
+	OutOfStock          ErrorCode = "Out Of Stock"
+	PaymentDeclined     ErrorCode = "Payment Declined"
+	GatewayTimeout      ErrorCode = "Gateway Timeout"
 )
@@ -0,0 +1,65 @@
+// (C) Copyright 2022-2023 Hewlett Packard Enterprise Development LP
+
+// Package health serves the liveness and readiness probes of the services.
+package health
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/utils"
+)
+
+/*
+package name    : health
+project         : qt-test-application
+*/
+
+const (
+	StatusPath = "/status"
+	ReadyPath  = "/ready"
+)
+
+var errNotReady = errors.New("service not ready")
+
+// Readiness tracks whether a service can serve requests, e.g. once its
+// database is connected. The zero value is not ready.
+type Readiness struct {
+	ready atomic.Bool
+}
+
+func (rd *Readiness) SetReady() {
+	rd.ready.Store(true)
+}
+
+func (rd *Readiness) Ready() bool {
+	return rd.ready.Load()
+}
+
+// Register adds the liveness probe, which succeeds as long as the process
+// serves HTTP, and the readiness probe to router.
+func (rd *Readiness) Register(router *mux.Router) {
+	router.HandleFunc(StatusPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}).Methods(http.MethodGet)
+	router.HandleFunc(ReadyPath, func(w http.ResponseWriter, r *http.Request) {
+		if !rd.Ready() {
+			utils.WriteErrorResponse(w, http.StatusServiceUnavailable, errNotReady)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}).Methods(http.MethodGet)
+}
+
+// Middleware rejects requests other than the probes with 503 until the service is ready.
+func (rd *Readiness) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rd.Ready() && r.URL.Path != StatusPath && r.URL.Path != ReadyPath {
+			utils.WriteErrorResponse(w, http.StatusServiceUnavailable, errNotReady)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
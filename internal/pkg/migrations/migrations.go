@@ -0,0 +1,343 @@
+// (C) Copyright 2022-2023 Hewlett Packard Enterprise Development LP
+
+// Package migrations applies the versioned schema of the services' database.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+package name    : migrations
+project         : qt-test-application
+*/
+
+const (
+	MySQL    = "mysql"
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+
+	lockName    = "schema_migrations"
+	lockTimeout = 60 * time.Second
+	// lockKey is the postgres advisory lock id, an arbitrary application wide constant.
+	lockKey = 7243019
+)
+
+//go:embed sql
+var files embed.FS
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// dialect holds the statements that differ between database systems.
+type dialect struct {
+	createTable   string
+	insertVersion string
+	deleteVersion string
+	lock          func(ctx context.Context, conn *sql.Conn) error
+	// unlock is given the error the migrations failed with, nil if none.
+	unlock func(ctx context.Context, conn *sql.Conn, failed error) error
+}
+
+var dialects = map[string]dialect{
+	MySQL: {
+		createTable: `CREATE TABLE IF NOT EXISTS SCHEMA_MIGRATIONS(
+	VERSION bigint primary key,
+	NAME text,
+	APPLIED_AT datetime
+)`,
+		insertVersion: `INSERT INTO SCHEMA_MIGRATIONS(VERSION, NAME, APPLIED_AT) VALUES (?, ?, ?)`,
+		deleteVersion: `DELETE FROM SCHEMA_MIGRATIONS WHERE VERSION = ?`,
+		lock: func(ctx context.Context, conn *sql.Conn) error {
+			var got sql.NullInt64
+			if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, lockName, int(lockTimeout.Seconds())).Scan(&got); err != nil {
+				return err
+			}
+			if got.Int64 != 1 {
+				return fmt.Errorf("timed out after %s", lockTimeout)
+			}
+			return nil
+		},
+		unlock: func(ctx context.Context, conn *sql.Conn, _ error) error {
+			_, err := conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, lockName)
+			return err
+		},
+	},
+	Postgres: {
+		createTable: `CREATE TABLE IF NOT EXISTS SCHEMA_MIGRATIONS(
+	VERSION bigint primary key,
+	NAME text,
+	APPLIED_AT timestamp
+)`,
+		insertVersion: `INSERT INTO SCHEMA_MIGRATIONS(VERSION, NAME, APPLIED_AT) VALUES ($1, $2, $3)`,
+		deleteVersion: `DELETE FROM SCHEMA_MIGRATIONS WHERE VERSION = $1`,
+		lock: func(ctx context.Context, conn *sql.Conn) error {
+			ctx, cancel := context.WithTimeout(ctx, lockTimeout)
+			defer cancel()
+			_, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+			return err
+		},
+		unlock: func(ctx context.Context, conn *sql.Conn, _ error) error {
+			_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey)
+			return err
+		},
+	},
+	SQLite: {
+		createTable: `CREATE TABLE IF NOT EXISTS SCHEMA_MIGRATIONS(
+	VERSION bigint primary key,
+	NAME text,
+	APPLIED_AT datetime
+)`,
+		insertVersion: `INSERT INTO SCHEMA_MIGRATIONS(VERSION, NAME, APPLIED_AT) VALUES (?, ?, ?)`,
+		deleteVersion: `DELETE FROM SCHEMA_MIGRATIONS WHERE VERSION = ?`,
+		// sqlite locks the whole file: an immediate transaction keeps other
+		// writers out until the migrations are committed. If one failed, they
+		// are all rolled back, so that no table is left without its version.
+		lock: func(ctx context.Context, conn *sql.Conn) error {
+			_, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`)
+			return err
+		},
+		unlock: func(ctx context.Context, conn *sql.Conn, failed error) error {
+			stmt := `COMMIT`
+			if failed != nil {
+				stmt = `ROLLBACK`
+			}
+			_, err := conn.ExecContext(ctx, stmt)
+			return err
+		},
+	},
+}
+
+// Migration is one schema version with the SQL to apply and revert it.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []Migration
+}
+
+// New returns a Migrator for the embedded migrations of the given dialect.
+func New(db *sql.DB, dialectName string) (*Migrator, error) {
+	d, ok := dialects[dialectName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported migration dialect %q", dialectName)
+	}
+
+	migrations, err := load(dialectName)
+	if err != nil {
+		return nil, fmt.Errorf("load migrations error: %w", err)
+	}
+
+	return &Migrator{db: db, dialect: d, migrations: migrations}, nil
+}
+
+// Close closes the underlying database.
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// Up applies all pending migrations in version order and returns the ones it applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := done[mig.Version]; ok {
+				continue
+			}
+			if err := execAll(ctx, conn, mig.Up); err != nil {
+				return fmt.Errorf("migration %d_%s up error: %w", mig.Version, mig.Name, err)
+			}
+			if _, err := conn.ExecContext(ctx, m.dialect.insertVersion, mig.Version, mig.Name, time.Now().UTC()); err != nil {
+				return fmt.Errorf("record migration %d error: %w", mig.Version, err)
+			}
+			applied = append(applied, mig)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the last steps applied migrations and returns the ones it reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := done[mig.Version]; !ok {
+				continue
+			}
+			if err := execAll(ctx, conn, mig.Down); err != nil {
+				return fmt.Errorf("migration %d_%s down error: %w", mig.Version, mig.Name, err)
+			}
+			if _, err := conn.ExecContext(ctx, m.dialect.deleteVersion, mig.Version); err != nil {
+				return fmt.Errorf("remove migration %d error: %w", mig.Version, err)
+			}
+			reverted = append(reverted, mig)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status lists every known migration with the time it was applied, if any.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var status []Status
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			s := Status{Migration: mig}
+			if at, ok := done[mig.Version]; ok {
+				at := at
+				s.AppliedAt = &at
+			}
+			status = append(status, s)
+		}
+		return nil
+	})
+	return status, err
+}
+
+// withLock runs fn on a dedicated connection holding the migration lock, so
+// services starting at the same time apply migrations one after the other.
+func (m *Migrator) withLock(ctx context.Context, fn func(*sql.Conn) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get connection error: %w", err)
+	}
+	defer conn.Close()
+
+	if err := m.dialect.lock(ctx, conn); err != nil {
+		return fmt.Errorf("acquire migration lock error: %w", err)
+	}
+	defer func() {
+		if unlockErr := m.dialect.unlock(context.Background(), conn, err); unlockErr != nil {
+			log.Printf("release migration lock error: %v", unlockErr)
+			// the lock belongs to the session: discard the connection instead of
+			// returning it to the pool still holding the lock.
+			_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, m.dialect.createTable); err != nil {
+		return fmt.Errorf("create migrations table error: %w", err)
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT VERSION, APPLIED_AT FROM SCHEMA_MIGRATIONS`)
+	if err != nil {
+		return nil, fmt.Errorf("query applied migrations error: %w", err)
+	}
+	defer rows.Close()
+
+	done := map[int64]time.Time{}
+	for rows.Next() {
+		var (
+			version int64
+			at      time.Time
+		)
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("row scan error: %w", err)
+		}
+		done[version] = at
+	}
+	return done, rows.Err()
+}
+
+func load(dialectName string) ([]Migration, error) {
+	dir := path.Join("sql", dialectName)
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		match := fileName.FindStringSubmatch(e.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", e.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		b, err := fs.ReadFile(files, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = mig
+		} else if mig.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %s and %s", version, mig.Name, match[2])
+		}
+		if match[3] == "up" {
+			mig.Up = string(b)
+		} else {
+			mig.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down files", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// execAll runs each ;-terminated statement of a migration file in turn.
+func execAll(ctx context.Context, conn *sql.Conn, script string) error {
+	for _, stmt := range strings.Split(script, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
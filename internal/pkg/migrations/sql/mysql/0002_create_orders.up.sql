@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS ORDERS(
+	ID int primary key auto_increment,
+	ACCOUNT text,
+	PRODUCT_NAME text,
+	PRICE int,
+	ORDER_STATUS text
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS LEDGER_ENTRIES;
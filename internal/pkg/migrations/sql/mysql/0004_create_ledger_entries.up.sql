@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS LEDGER_ENTRIES(
+	ID int primary key auto_increment,
+	USER_ID int not null default 0,
+	ACCOUNT text not null,
+	AMOUNT int not null,
+	REASON text not null,
+	ORDER_ID int,
+	PAYMENT_ID int,
+	CREATED_AT datetime not null,
+	INDEX LEDGER_ENTRIES_USER_ID (USER_ID, ID)
+);
+-- record the balances from before the ledger as opening entries, against the
+-- opening account.
+INSERT INTO LEDGER_ENTRIES(USER_ID, ACCOUNT, AMOUNT, REASON, CREATED_AT)
+	SELECT ID, COALESCE(ACCOUNT, ''), AMOUNT, 'opening balance', CURRENT_TIMESTAMP FROM USERS WHERE AMOUNT <> 0;
+INSERT INTO LEDGER_ENTRIES(USER_ID, ACCOUNT, AMOUNT, REASON, CREATED_AT)
+	SELECT 0, 'opening', -AMOUNT, 'opening balance', CURRENT_TIMESTAMP FROM USERS WHERE AMOUNT <> 0;
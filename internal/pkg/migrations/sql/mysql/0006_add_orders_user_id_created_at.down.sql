@@ -0,0 +1,3 @@
+DROP INDEX ORDERS_USER_ID ON ORDERS;
+ALTER TABLE ORDERS DROP COLUMN CREATED_AT;
+ALTER TABLE ORDERS DROP COLUMN USER_ID;
@@ -0,0 +1,3 @@
+ALTER TABLE ORDERS ADD COLUMN USER_ID int NULL;
+ALTER TABLE ORDERS ADD COLUMN CREATED_AT datetime NULL;
+CREATE INDEX ORDERS_USER_ID ON ORDERS(USER_ID, ID);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS STOCK_RESERVATIONS;
+DROP TABLE IF EXISTS PRODUCTS;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS PAYMENTS(
+	ID int primary key auto_increment,
+	USER_ID int not null,
+	ORDER_ID int,
+	REASON varchar(16) not null,
+	AMOUNT int not null,
+	DIRECTION varchar(16) not null,
+	STATUS varchar(16) not null,
+	ERROR text,
+	CREATED_AT datetime not null,
+	UPDATED_AT datetime not null
+);
+CREATE INDEX PAYMENTS_USER_ID ON PAYMENTS(USER_ID, ID);
+CREATE INDEX PAYMENTS_ORDER_ID ON PAYMENTS(ORDER_ID);
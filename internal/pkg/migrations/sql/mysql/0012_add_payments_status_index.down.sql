@@ -0,0 +1 @@
+DROP INDEX PAYMENTS_STATUS ON PAYMENTS;
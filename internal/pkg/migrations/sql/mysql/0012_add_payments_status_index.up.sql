@@ -0,0 +1 @@
+CREATE INDEX PAYMENTS_STATUS ON PAYMENTS(STATUS, UPDATED_AT);
@@ -0,0 +1,4 @@
+DROP INDEX SAGAS_LEASE ON SAGAS;
+CREATE INDEX SAGAS_STATUS ON SAGAS(STATUS, UPDATED_AT);
+ALTER TABLE SAGAS DROP COLUMN LEASE_UNTIL;
+ALTER TABLE SAGAS DROP COLUMN LEASE_OWNER;
@@ -0,0 +1,4 @@
+ALTER TABLE SAGAS ADD COLUMN LEASE_OWNER varchar(64) NULL;
+ALTER TABLE SAGAS ADD COLUMN LEASE_UNTIL datetime NULL;
+DROP INDEX SAGAS_STATUS ON SAGAS;
+CREATE INDEX SAGAS_LEASE ON SAGAS(STATUS, LEASE_UNTIL);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS USERS(
+	ID serial primary key,
+	USER_NAME text,
+	ACCOUNT text,
+	AMOUNT int default 0
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS ORDERS(
+	ID serial primary key,
+	ACCOUNT text,
+	PRODUCT_NAME text,
+	PRICE int,
+	ORDER_STATUS text
+);
@@ -0,0 +1 @@
+ALTER TABLE USERS ADD COLUMN VERSION int NOT NULL DEFAULT 0;
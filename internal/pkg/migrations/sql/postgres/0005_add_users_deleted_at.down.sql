@@ -0,0 +1 @@
+ALTER TABLE USERS DROP COLUMN DELETED_AT;
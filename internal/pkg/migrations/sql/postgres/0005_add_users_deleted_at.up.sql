@@ -0,0 +1 @@
+ALTER TABLE USERS ADD COLUMN DELETED_AT timestamp NULL;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS ORDERS_USER_ID;
+ALTER TABLE ORDERS DROP COLUMN CREATED_AT;
+ALTER TABLE ORDERS DROP COLUMN USER_ID;
@@ -0,0 +1 @@
+UPDATE ORDERS SET ORDER_STATUS = 'SUCCESS' WHERE ORDER_STATUS = 'PAID';
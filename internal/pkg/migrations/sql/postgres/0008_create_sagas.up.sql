@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS SAGAS(
+	ID serial primary key,
+	ORDER_ID int not null,
+	STEP int not null,
+	STATUS varchar(16) not null,
+	ERROR text,
+	VERSION int not null default 0,
+	CREATED_AT timestamp not null,
+	UPDATED_AT timestamp not null
+);
+CREATE INDEX IF NOT EXISTS SAGAS_STATUS ON SAGAS(STATUS, UPDATED_AT);
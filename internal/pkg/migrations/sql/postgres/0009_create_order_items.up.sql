@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS ORDER_ITEMS(
+	ID serial primary key,
+	ORDER_ID int not null,
+	PRODUCT_ID int not null,
+	PRODUCT_NAME text not null,
+	UNIT_PRICE int not null,
+	QUANTITY int not null
+);
+CREATE INDEX IF NOT EXISTS ORDER_ITEMS_ORDER_ID ON ORDER_ITEMS(ORDER_ID);
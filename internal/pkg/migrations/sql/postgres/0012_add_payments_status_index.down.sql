@@ -0,0 +1 @@
+DROP INDEX IF EXISTS PAYMENTS_STATUS;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS PAYMENTS_STATUS ON PAYMENTS(STATUS, UPDATED_AT);
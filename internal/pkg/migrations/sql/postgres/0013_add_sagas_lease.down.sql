@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS SAGAS_LEASE;
+CREATE INDEX IF NOT EXISTS SAGAS_STATUS ON SAGAS(STATUS, UPDATED_AT);
+ALTER TABLE SAGAS DROP COLUMN LEASE_UNTIL;
+ALTER TABLE SAGAS DROP COLUMN LEASE_OWNER;
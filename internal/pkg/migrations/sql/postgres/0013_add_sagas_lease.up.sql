@@ -0,0 +1,4 @@
+ALTER TABLE SAGAS ADD COLUMN LEASE_OWNER varchar(64) NULL;
+ALTER TABLE SAGAS ADD COLUMN LEASE_UNTIL timestamp NULL;
+DROP INDEX IF EXISTS SAGAS_STATUS;
+CREATE INDEX IF NOT EXISTS SAGAS_LEASE ON SAGAS(STATUS, LEASE_UNTIL);
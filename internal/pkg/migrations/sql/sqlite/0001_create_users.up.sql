@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS USERS(
+	ID integer primary key autoincrement,
+	USER_NAME text,
+	ACCOUNT text,
+	AMOUNT int default 0
+);
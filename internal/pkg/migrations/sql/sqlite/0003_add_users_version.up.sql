@@ -0,0 +1 @@
+ALTER TABLE USERS ADD COLUMN VERSION integer NOT NULL DEFAULT 0;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS LEDGER_ENTRIES(
+	ID integer primary key autoincrement,
+	USER_ID int not null default 0,
+	ACCOUNT text not null,
+	AMOUNT int not null,
+	REASON text not null,
+	ORDER_ID int,
+	PAYMENT_ID int,
+	CREATED_AT datetime not null
+);
+CREATE INDEX IF NOT EXISTS LEDGER_ENTRIES_USER_ID ON LEDGER_ENTRIES(USER_ID, ID);
+-- record the balances from before the ledger as opening entries, against the
+-- opening account.
+INSERT INTO LEDGER_ENTRIES(USER_ID, ACCOUNT, AMOUNT, REASON, CREATED_AT)
+	SELECT ID, COALESCE(ACCOUNT, ''), AMOUNT, 'opening balance', CURRENT_TIMESTAMP FROM USERS WHERE AMOUNT <> 0;
+INSERT INTO LEDGER_ENTRIES(USER_ID, ACCOUNT, AMOUNT, REASON, CREATED_AT)
+	SELECT 0, 'opening', -AMOUNT, 'opening balance', CURRENT_TIMESTAMP FROM USERS WHERE AMOUNT <> 0;
@@ -0,0 +1 @@
+UPDATE ORDERS SET ORDER_STATUS = 'PAID' WHERE ORDER_STATUS = 'SUCCESS';
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS SAGAS(
+	ID integer primary key autoincrement,
+	ORDER_ID int not null,
+	STEP int not null,
+	STATUS varchar(16) not null,
+	ERROR text,
+	VERSION int not null default 0,
+	CREATED_AT datetime not null,
+	UPDATED_AT datetime not null
+);
+CREATE INDEX IF NOT EXISTS SAGAS_STATUS ON SAGAS(STATUS, UPDATED_AT);
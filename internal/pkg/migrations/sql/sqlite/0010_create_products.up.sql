@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS PRODUCTS(
+	ID integer primary key autoincrement,
+	NAME text not null,
+	PRICE int not null,
+	STOCK int not null default 0
+);
+CREATE TABLE IF NOT EXISTS STOCK_RESERVATIONS(
+	ID integer primary key autoincrement,
+	ORDER_ID int not null,
+	PRODUCT_ID int not null,
+	QUANTITY int not null,
+	RELEASED_AT datetime NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS STOCK_RESERVATIONS_ORDER_ID ON STOCK_RESERVATIONS(ORDER_ID, PRODUCT_ID);
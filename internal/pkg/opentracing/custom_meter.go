@@ -0,0 +1,48 @@
+// (C) Copyright 2022-2023 Hewlett Packard Enterprise Development LP
+
+// Package opentracing contains ...
+package opentracing
+
+import (
+	"context"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"google.golang.org/grpc/credentials"
+	"log"
+)
+
+/*
+package name    : opentracing
+project         : qt-test-application
+*/
+
+// InitMeter configures an OpenTelemetry metric exporter and meter provider
+func InitMeter(serviceConf *config.ServiceConfigurations, serviceName string) *sdkmetric.MeterProvider {
+
+	secureOption := otlpmetricgrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")) // config can be passed to configure TLS
+	if len(serviceConf.InsecureMode) > 0 {
+		secureOption = otlpmetricgrpc.WithInsecure()
+	}
+
+	exporter, err := otlpmetricgrpc.New(
+		context.Background(),
+		secureOption,
+		otlpmetricgrpc.WithEndpoint(serviceConf.Collector),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+
+	otel.SetMeterProvider(meterProvider)
+
+	return meterProvider
+}
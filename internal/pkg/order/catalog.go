@@ -0,0 +1,106 @@
+package order
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/repository"
+)
+
+// product is a product of the catalog service, which owns the prices and the
+// stock levels.
+type product struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Price int    `json:"price"`
+}
+
+type stockReservation struct {
+	OrderID int64                  `json:"order_id"`
+	Items   []stockReservationItem `json:"items"`
+}
+
+type stockReservationItem struct {
+	ProductID int64 `json:"product_id"`
+	Quantity  int   `json:"quantity"`
+}
+
+// reservation is a reservation of the catalog service, released once
+// ReleasedAt is set.
+type reservation struct {
+	ReleasedAt *time.Time `json:"released_at"`
+}
+
+// getProducts returns the products of items from the catalog service, by ID.
+func getProducts(ctx context.Context, items []orderItem) (map[int64]product, error) {
+	products := make(map[int64]product, len(items))
+	for _, item := range items {
+		if _, ok := products[item.ProductID]; ok {
+			continue
+		}
+
+		var p product
+		url := fmt.Sprintf("http://%s/products/%d", catalogUrl, item.ProductID)
+		if err := sendJSON(ctx, http.MethodGet, url, nil, &p); err != nil {
+			return nil, fmt.Errorf("get product error: %w", err)
+		}
+		products[p.ID] = p
+	}
+	return products, nil
+}
+
+// reserveStock takes the items of o out of stock. The catalog service
+// reserves an order once.
+func reserveStock(ctx context.Context, o *repository.Order) error {
+	// the orders created before line items were recorded have no stock.
+	if len(o.Items) == 0 {
+		return nil
+	}
+
+	request := stockReservation{OrderID: o.ID}
+	for _, item := range o.Items {
+		request.Items = append(request.Items, stockReservationItem{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+
+	url := fmt.Sprintf("http://%s/reservations", catalogUrl)
+	if err := sendJSON(ctx, http.MethodPost, url, request, nil); err != nil {
+		return fmt.Errorf("reserve stock error: %w", err)
+	}
+	return nil
+}
+
+// releaseStock puts the items reserved for o back in stock. The catalog
+// service ignores the orders it did not reserve.
+func releaseStock(ctx context.Context, o *repository.Order) error {
+	if len(o.Items) == 0 {
+		return nil
+	}
+
+	url := fmt.Sprintf("http://%s/reservations/%d", catalogUrl, o.ID)
+	if err := sendJSON(ctx, http.MethodDelete, url, nil, nil); err != nil {
+		return fmt.Errorf("release stock error: %w", err)
+	}
+	return nil
+}
+
+// holdsReservation reports whether the catalog service still keeps items
+// reserved for o out of stock.
+func holdsReservation(ctx context.Context, o *repository.Order) (bool, error) {
+	if len(o.Items) == 0 {
+		return false, nil
+	}
+
+	var reservations []reservation
+	url := fmt.Sprintf("http://%s/reservations/%d", catalogUrl, o.ID)
+	if err := sendJSON(ctx, http.MethodGet, url, nil, &reservations); err != nil {
+		return false, fmt.Errorf("list reservations error: %w", err)
+	}
+	for _, res := range reservations {
+		if res.ReleasedAt == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,69 @@
+package order
+
+import (
+	"context"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/repository"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Order statuses. An order is created PENDING and becomes PAID once its price
+// is charged. CANCELLED, REFUNDED and FAILED are final.
+const (
+	StatusPending   = "PENDING"
+	StatusPaid      = "PAID"
+	StatusFulfilled = "FULFILLED"
+	StatusCancelled = "CANCELLED"
+	StatusRefunded  = "REFUNDED"
+	StatusFailed    = "FAILED"
+)
+
+// transitions lists the statuses an order can go to from each status.
+var transitions = map[string][]string{
+	StatusPending:   {StatusPaid, StatusCancelled, StatusFailed},
+	StatusPaid:      {StatusFulfilled, StatusCancelled, StatusRefunded},
+	StatusFulfilled: {StatusRefunded},
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// isCharged reports whether the price of an order in status has been charged
+// and not given back.
+func isCharged(status string) bool {
+	return status == StatusPaid || status == StatusFulfilled
+}
+
+// holdsStock reports whether the items of an order in status are kept out of
+// stock.
+func holdsStock(status string) bool {
+	return status != StatusCancelled && status != StatusFailed
+}
+
+// setStatus moves o to status, if the transition is allowed, and records it as
+// an event of the span of ctx.
+func setStatus(ctx context.Context, orders repository.OrderRepository, o *repository.Order, status string) error {
+	from := o.Status
+	if !canTransition(from, status) {
+		return gerrors.Newf(gerrors.InvalidTransition, "order %d cannot go from %s to %s", o.ID, from, status)
+	}
+
+	if err := orders.UpdateStatus(ctx, o, status); err != nil {
+		return err
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("order status changed", trace.WithAttributes(
+		attribute.Int64("orderID", o.ID),
+		attribute.String("from", from),
+		attribute.String("to", status),
+	))
+	return nil
+}
@@ -0,0 +1,258 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/repository"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// resumeBatch bounds the sagas resumed at once.
+const resumeBatch = 50
+
+var (
+	// sagaOwner names this instance in the leases of the sagas it runs.
+	sagaOwner string
+	// sagaLease is how long a saga is held per step, see lease.
+	sagaLease time.Duration
+)
+
+// sagaStep is a step of the placement of an order. compensate undoes run and
+// is nil if there is nothing to undo. Steps and compensations may run more
+// than once, after a crash, so they must be idempotent.
+type sagaStep struct {
+	name         string
+	run          func(ctx context.Context, o *repository.Order) error
+	compensation string
+	compensate   func(ctx context.Context, o *repository.Order) error
+}
+
+// placementSteps are the steps placing an order. The first one is run by
+// startPlacement, which inserts the order and its saga together.
+var placementSteps = []sagaStep{
+	{name: "reserve order", compensation: "cancel order", compensate: failOrder},
+	{name: "reserve stock", run: reserveStock, compensation: "release stock", compensate: releaseStock},
+	{name: "debit payment", run: debitOrder, compensation: "refund payment", compensate: refundOrder},
+	{name: "confirm order", run: confirmOrder},
+}
+
+// startPlacement inserts o as a pending order along with the saga placing it.
+func startPlacement(ctx context.Context, o *repository.Order) (repository.Saga, error) {
+	ctx, span := tracer.Start(ctx, placementSteps[0].name)
+	defer span.End()
+
+	saga := repository.Saga{Step: 1, Status: repository.SagaRunning}
+	lease(&saga)
+	if err := store.WithTx(ctx, func(tx repository.Store) error {
+		if err := tx.Orders().Create(ctx, o); err != nil {
+			return err
+		}
+		saga.OrderID = o.ID
+		return tx.Sagas().Create(ctx, &saga)
+	}); err != nil {
+		span.SetStatus(codes.Error, utils.ErrorMessage(err))
+		return repository.Saga{}, err
+	}
+
+	span.SetAttributes(attribute.Int64("orderID", o.ID), attribute.Int64("sagaID", saga.ID))
+	return saga, nil
+}
+
+// runSaga runs the steps of s from s.Step on. If one fails, the steps run so
+// far, the failed one included, are compensated in reverse order and the
+// failure is returned. The state of s is saved after every step, so that a
+// saga left unfinished can be resumed.
+func runSaga(ctx context.Context, s *repository.Saga, o *repository.Order) error {
+	// the saga and the order are checked against their latest state, replicas
+	// may lag behind.
+	ctx = datastore.WithPrimary(ctx)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("sagaID", s.ID), attribute.Int64("orderID", o.ID))
+
+	var failure error
+	for s.Status == repository.SagaRunning {
+		step := placementSteps[s.Step]
+		if err := runStep(ctx, s.LeaseUntil, step.name, step.run, o); err != nil {
+			// the failed step may have been applied anyway, e.g. if the
+			// payment service timed out, so it is compensated too.
+			failure = err
+			s.Status, s.Error = repository.SagaCompensating, utils.ErrorMessage(err)
+		}
+		s.Step++
+		if s.Status == repository.SagaRunning && s.Step == len(placementSteps) {
+			s.Status = repository.SagaCompleted
+		}
+		if err := saveSaga(ctx, s); err != nil {
+			return err
+		}
+	}
+	if s.Status == repository.SagaCompleted {
+		return nil
+	}
+
+	if err := compensate(ctx, s, o); err != nil {
+		if failure == nil {
+			return err
+		}
+		// the saga is resumed later, the caller gets the cause of the failure.
+		log.Printf("compensate saga %d error: %v", s.ID, err)
+	}
+	if failure == nil {
+		failure = errors.New(s.Error)
+	}
+	return failure
+}
+
+// compensate undoes the s.Step first steps of s, last first.
+func compensate(ctx context.Context, s *repository.Saga, o *repository.Order) error {
+	// the order may have changed since it was read, e.g. if it was cancelled.
+	latest, err := store.Orders().Get(ctx, o.ID)
+	if err != nil {
+		return err
+	}
+	*o = latest
+
+	for s.Step > 0 {
+		step := placementSteps[s.Step-1]
+		if step.compensate != nil {
+			if err := runStep(ctx, s.LeaseUntil, step.compensation, step.compensate, o); err != nil {
+				return err
+			}
+		}
+		s.Step--
+		if s.Step == 0 {
+			s.Status = repository.SagaCompensated
+		}
+		if err := saveSaga(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStep runs fn in a span named name, until deadline at the latest: another
+// instance may take the saga over from then on.
+func runStep(ctx context.Context, deadline time.Time, name string, fn func(ctx context.Context, o *repository.Order) error, o *repository.Order) error {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, name)
+	defer span.End()
+	span.SetAttributes(attribute.Int64("orderID", o.ID))
+
+	if err := fn(ctx, o); err != nil {
+		span.SetStatus(codes.Error, utils.ErrorMessage(err))
+		return err
+	}
+	return nil
+}
+
+// saveSaga saves s with a new lease and records its new state as an event of
+// the span of ctx. It fails with a gerrors.Conflict error if another instance
+// saved s meanwhile.
+func saveSaga(ctx context.Context, s *repository.Saga) error {
+	lease(s)
+	if err := store.Sagas().Save(ctx, s); err != nil {
+		return err
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("saga state changed", trace.WithAttributes(
+		attribute.Int("step", s.Step),
+		attribute.String("status", s.Status),
+	))
+	return nil
+}
+
+func debitOrder(ctx context.Context, o *repository.Order) error {
+	return sendPayment(ctx, "debit", *o)
+}
+
+// refundOrder gives the price of o back. The user service ignores the refunds
+// of orders it did not charge.
+func refundOrder(ctx context.Context, o *repository.Order) error {
+	return sendPayment(ctx, "refund", *o)
+}
+
+func confirmOrder(ctx context.Context, o *repository.Order) error {
+	if o.Status == StatusPaid {
+		return nil
+	}
+	return setStatus(ctx, store.Orders(), o, StatusPaid)
+}
+
+// failOrder marks o as failed, unless it already reached a final status.
+func failOrder(ctx context.Context, o *repository.Order) error {
+	if !canTransition(o.Status, StatusFailed) {
+		return nil
+	}
+	return setStatus(ctx, store.Orders(), o, StatusFailed)
+}
+
+// lease holds s for this instance until the next step, which must end by
+// s.LeaseUntil. Saving s takes the lease.
+func lease(s *repository.Saga) {
+	s.LeaseOwner, s.LeaseUntil = sagaOwner, time.Now().Add(sagaLease)
+}
+
+// resumeSagas resumes the placements left unfinished, whose lease expired,
+// every interval until ctx is done.
+func resumeSagas(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		resumeExpired(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func resumeExpired(ctx context.Context) {
+	sagas, err := store.Sagas().ListExpired(datastore.WithPrimary(ctx), time.Now(), resumeBatch)
+	if err != nil {
+		log.Printf("list expired sagas error: %v", err)
+		return
+	}
+
+	for i := range sagas {
+		if err := resumeSaga(ctx, &sagas[i]); err != nil {
+			log.Printf("resume saga %d error: %v", sagas[i].ID, err)
+		}
+	}
+}
+
+func resumeSaga(ctx context.Context, s *repository.Saga) error {
+	ctx, span := tracer.Start(ctx, "resume order saga")
+	defer span.End()
+	ctx = datastore.WithPrimary(ctx)
+
+	// saving the saga takes its lease over: another instance resuming it as
+	// well fails to save it and leaves it.
+	if err := saveSaga(ctx, s); err != nil {
+		if datastore.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+
+	o, err := store.Orders().Get(ctx, s.OrderID)
+	if err != nil {
+		return err
+	}
+	if err := runSaga(ctx, s, &o); err != nil {
+		span.SetStatus(codes.Error, utils.ErrorMessage(err))
+		// a compensated saga failed as it should, the others are resumed again.
+		if s.Status != repository.SagaCompensated {
+			return err
+		}
+	}
+	return nil
+}
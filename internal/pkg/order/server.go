@@ -11,16 +11,23 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/health"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/repository"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/utils"
 	"github.com/rs/cors"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
-	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
@@ -30,11 +37,17 @@ project         : qt-test-application
 
 const serviceName = "order-service"
 
+// maxStatusAttempts bounds the retries of a status change of an order updated concurrently.
+const maxStatusAttempts = 3
+
 var (
-	db      datastore.DB
-	srv     *http.Server
-	userUrl string
-	tracer  trace.Tracer
+	store      repository.Store
+	srv        *http.Server
+	userUrl    string
+	paymentUrl string
+	catalogUrl string
+	tracer     trace.Tracer
+	ready      health.Readiness
 )
 
 func SetupServer(cnf *config.ServiceConfigurations) {
@@ -42,7 +55,13 @@ func SetupServer(cnf *config.ServiceConfigurations) {
 
 	router := mux.NewRouter()
 	router.HandleFunc("/orders", createOrder).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/orders", listOrders).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/orders/{orderID}", getOrder).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/orders/{orderID}/status", updateOrderStatus).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/orders/{orderID}/cancel", cancelOrder).Methods(http.MethodPost, http.MethodOptions)
+	ready.Register(router)
 	router.Use(utils.LoggingMW)
+	router.Use(ready.Middleware)
 	router.Use(otelmux.Middleware(serviceName))
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
@@ -52,6 +71,8 @@ func SetupServer(cnf *config.ServiceConfigurations) {
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt)
 	userUrl = cnf.UserURL
+	paymentUrl = cnf.PaymentURL
+	catalogUrl = cnf.CatalogURL
 
 	srv = &http.Server{
 		Addr:    cnf.OrderURL,
@@ -69,18 +90,101 @@ func SetupServer(cnf *config.ServiceConfigurations) {
 	}
 }
 
+// InitDB connects to the database in the background. Until it is connected,
+// the service reports not ready instead of exiting. Once connected, it resumes
+// the order placements left unfinished by other instances.
 func InitDB(cnf *config.ServiceConfigurations) {
-	var err error
-	if db, err = datastore.New(cnf); err != nil {
-		log.Fatalf("failed to initialize db: %v", err)
+	go func() {
+		conn, err := datastore.New(cnf)
+		if err != nil {
+			log.Fatalf("failed to initialize db: %v", err)
+		}
+		store = repository.NewStore(conn)
+		sagaOwner, sagaLease = instanceName(), cnf.SagaLease
+		ready.SetReady()
+
+		resumeSagas(context.Background(), cnf.SagaResumeInterval)
+	}()
+}
+
+// instanceName identifies the process among the instances of the service.
+func instanceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
 	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
 }
 
 type orderData struct {
-	ID          int64  `json:"id"`
-	UserID      int    `json:"user_id" validate:"required"`
-	ProductName string `json:"product_name" validate:"required"`
-	Price       int    `json:"price" validate:"required"`
+	ID     int64       `json:"id"`
+	UserID int         `json:"user_id" validate:"required"`
+	Items  []orderItem `json:"items" validate:"required,min=1,dive"`
+	// set by the service, ignored in requests.
+	Total     int        `json:"total"`
+	Status    string     `json:"status,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+type orderItem struct {
+	ProductID int64 `json:"product_id" validate:"required,gt=0"`
+	Quantity  int   `json:"quantity" validate:"required,gt=0"`
+	// set by the service from the catalog, ignored in requests.
+	ProductName string `json:"product_name"`
+	UnitPrice   int    `json:"unit_price"`
+}
+
+// maxOrderTotal is the largest total the PRICE column holds.
+const maxOrderTotal = math.MaxInt32
+
+// newOrder returns the pending order for the items of request, at the prices
+// of products. Its total is computed from the items, whatever names, prices
+// and total the request holds.
+func newOrder(request orderData, products map[int64]product) (repository.Order, error) {
+	order := repository.Order{Status: StatusPending}
+	names := make([]string, 0, len(request.Items))
+	for _, item := range request.Items {
+		p := products[item.ProductID]
+		if p.Price > (maxOrderTotal-order.Price)/item.Quantity {
+			return repository.Order{}, gerrors.Newf(gerrors.BadRequest, "order total exceeds %d", maxOrderTotal)
+		}
+		order.Price += p.Price * item.Quantity
+		order.Items = append(order.Items, repository.OrderItem{
+			ProductID:   p.ID,
+			ProductName: p.Name,
+			UnitPrice:   p.Price,
+			Quantity:    item.Quantity,
+		})
+		names = append(names, p.Name)
+	}
+	order.ProductName = strings.Join(names, ", ")
+	return order, nil
+}
+
+func newOrderData(o repository.Order) orderData {
+	data := orderData{
+		ID:     o.ID,
+		UserID: int(o.UserID),
+		Items:  make([]orderItem, 0, len(o.Items)),
+		Total:  o.Price,
+		Status: o.Status,
+	}
+	for _, item := range o.Items {
+		data.Items = append(data.Items, orderItem{
+			ProductID:   item.ProductID,
+			ProductName: item.ProductName,
+			UnitPrice:   item.UnitPrice,
+			Quantity:    item.Quantity,
+		})
+	}
+	// the orders created before line items were recorded have one product.
+	if len(o.Items) == 0 && o.ProductName != "" {
+		data.Items = append(data.Items, orderItem{ProductName: o.ProductName, UnitPrice: o.Price, Quantity: 1})
+	}
+	if !o.CreatedAt.IsZero() {
+		data.CreatedAt = &o.CreatedAt
+	}
+	return data
 }
 
 type user struct {
@@ -96,66 +200,353 @@ func createOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	products, err := getProducts(r.Context(), request.Items)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	order, err := newOrder(request, products)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
 	// get user details from user service
+	var user user
 	url := fmt.Sprintf("http://%s/users/%d", userUrl, request.UserID)
-	userResponse, err := utils.SendRequest(r.Context(), http.MethodGet, url, nil)
+	if err := sendJSON(r.Context(), http.MethodGet, url, nil, &user); err != nil {
+		utils.WriteError(w, fmt.Errorf("get user error: %w", err))
+		return
+	}
+
+	order.UserID, order.Account = user.ID, user.Account
+
+	// basic check for the user balance
+	if user.Amount < order.Price {
+		utils.WriteError(w, gerrors.Newf(gerrors.InsufficientBalance, "insufficient balance. add %d more amount to account", order.Price-user.Amount))
+		return
+	}
+
+	// place the order: reserve it and its stock, charge the user through the
+	// payment service, which owns the balances, and confirm it. The user service
+	// checks the balance again: it may have changed since it was read.
+	ctx, span := tracer.Start(r.Context(), "place order")
+	defer span.End()
+
+	saga, err := startPlacement(ctx, &order)
 	if err != nil {
-		log.Printf("%v", err)
-		utils.WriteResponse(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, err)
+		return
+	}
+	if err := runSaga(ctx, &saga, &order); err != nil {
+		utils.WriteError(w, err)
 		return
 	}
 
-	b, err := ioutil.ReadAll(userResponse.Body)
+	// send response
+	utils.WriteResponse(w, http.StatusCreated, newOrderData(order))
+}
+
+func getOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+
+	ctx, span := tracer.Start(r.Context(), "get order")
+	defer span.End()
+	span.SetAttributes(attribute.String("orderID", orderID))
+
+	id, err := parseID("order", orderID)
 	if err != nil {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, err)
 		return
 	}
-	defer userResponse.Body.Close()
 
-	if userResponse.StatusCode != http.StatusOK {
-		utils.WriteErrorResponse(w, userResponse.StatusCode, fmt.Errorf("payment failed. got response: %s", b))
+	order, err := store.Orders().Get(ctx, id)
+	if err != nil {
+		utils.WriteError(w, err)
 		return
 	}
 
-	var user user
-	if err := json.Unmarshal(b, &user); err != nil {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, err)
+	utils.WriteResponse(w, http.StatusOK, newOrderData(order))
+}
+
+// listOrders lists the orders, oldest first. The query parameters user_id,
+// status, and from and to (RFC 3339 times) filter the orders, and limit and
+// cursor select the page.
+func listOrders(w http.ResponseWriter, r *http.Request) {
+	page, err := datastore.ReadPage(r)
+	if err != nil {
+		utils.WriteError(w, err)
 		return
 	}
 
-	// basic check for the user balance
-	if user.Amount < request.Price {
-		utils.WriteErrorResponse(w, http.StatusUnprocessableEntity, fmt.Errorf("insufficient balance. add %d more amount to account", request.Price-user.Amount))
+	filter, err := readOrderFilter(r)
+	if err != nil {
+		utils.WriteError(w, err)
 		return
 	}
 
-	// insert the order into order table
-	ctx, insertSpan := tracer.Start(r.Context(), "insert order")
-	id, err := db.InsertOne(ctx, datastore.InsertParams{
-		Query: `insert into ORDERS(ACCOUNT, PRODUCT_NAME, PRICE, ORDER_STATUS) VALUES (?,?,?, ?)`,
-		Vars:  []interface{}{user.Account, request.ProductName, request.Price, "SUCCESS"},
-	})
+	ctx, span := tracer.Start(r.Context(), "list orders")
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int64("userID", filter.UserID),
+		attribute.String("status", filter.Status),
+	)
+
+	orders, err := store.Orders().List(ctx, filter, page)
 	if err != nil {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, err)
-		insertSpan.End()
+		utils.WriteError(w, err)
 		return
 	}
-	insertSpan.End()
 
-	// update the pending amount in user table
-	ctx, updateSpan := tracer.Start(r.Context(), "update user amount")
-	if err := db.UpdateOne(ctx, datastore.UpdateParams{
-		Query: `update USERS set AMOUNT = AMOUNT - ? where ID = ?`,
-		Vars:  []interface{}{request.Price, user.ID},
+	response := datastore.PageResult[orderData]{Items: make([]orderData, 0, len(orders.Items)), NextCursor: orders.NextCursor}
+	for _, o := range orders.Items {
+		response.Items = append(response.Items, newOrderData(o))
+	}
+	utils.WriteResponse(w, http.StatusOK, response)
+}
+
+// statusData is a new status of an order. An unknown status is a bad request,
+// a known one the order cannot reach a conflict.
+type statusData struct {
+	Status string `json:"status" validate:"required,oneof=PENDING PAID FULFILLED CANCELLED REFUNDED FAILED"`
+}
+
+// updateOrderStatus moves an order to another status of its lifecycle. An
+// order only becomes PAID by being charged when it is placed.
+func updateOrderStatus(w http.ResponseWriter, r *http.Request) {
+	var request statusData
+	if err := utils.ReadBody(w, r, &request); err != nil {
+		return
+	}
+	if request.Status == StatusPaid {
+		utils.WriteError(w, gerrors.Newf(gerrors.InvalidTransition, "status %s is only set by charging the order", StatusPaid))
+		return
+	}
+
+	changeStatus(w, r, "update order status", request.Status)
+}
+
+// cancelOrder cancels a pending or paid order, refunding the price of a paid
+// one and putting its items back in stock. Cancelling a cancelled order
+// changes nothing.
+func cancelOrder(w http.ResponseWriter, r *http.Request) {
+	changeStatus(w, r, "cancel order", StatusCancelled)
+}
+
+// changeStatus moves the order of the request to status, refunding its user if
+// the order was charged and is cancelled or refunded, and putting its items
+// back in stock if it is cancelled. Moving an order to the status it is at
+// changes nothing, so that a request can be sent again.
+func changeStatus(w http.ResponseWriter, r *http.Request, spanName, status string) {
+	orderID := mux.Vars(r)["orderID"]
+
+	ctx, span := tracer.Start(r.Context(), spanName)
+	defer span.End()
+	span.SetAttributes(attribute.String("orderID", orderID), attribute.String("status", status))
+
+	id, err := parseID("order", orderID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	// the status is checked against the latest one, replicas may lag behind.
+	ctx = datastore.WithPrimary(ctx)
+	var (
+		order repository.Order
+		from  string
+	)
+	if err := datastore.RetryOnConflict(ctx, maxStatusAttempts, func() error {
+		if order, err = store.Orders().Get(ctx, id); err != nil {
+			return err
+		}
+		from = order.Status
+		if from == status {
+			return nil
+		}
+		return setStatus(ctx, store.Orders(), &order, status)
 	}); err != nil {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, err)
-		updateSpan.End()
+		utils.WriteError(w, err)
 		return
 	}
-	updateSpan.End()
 
-	// send response
-	response := request
-	response.ID = id
-	utils.WriteResponse(w, http.StatusCreated, response)
+	if from == status {
+		span.AddEvent("order status unchanged")
+		// the refund or the stock release may have failed after the status was
+		// changed. Only the steps not done yet are sent again: the refund if the
+		// order was charged and not refunded, and the release if the catalog
+		// service still holds stock for it.
+		if err := finishStatus(ctx, &order); err != nil {
+			utils.WriteError(w, err)
+			return
+		}
+		utils.WriteResponse(w, http.StatusOK, newOrderData(order))
+		return
+	}
+
+	// the refund is sent once the status change is stored, not in a
+	// transaction held open over the call. If it fails, the order goes back
+	// to its previous status so that the request can be retried.
+	if isCharged(from) && !isCharged(status) {
+		if err := refund(ctx, order); err != nil {
+			if rbErr := store.Orders().UpdateStatus(ctx, &order, from); rbErr != nil {
+				log.Printf("restore status %s of order %d error: %v", from, order.ID, rbErr)
+			}
+			utils.WriteError(w, err)
+			return
+		}
+	}
+	if holdsStock(from) && !holdsStock(status) {
+		if err := releaseStock(ctx, &order); err != nil {
+			utils.WriteError(w, err)
+			return
+		}
+	}
+
+	utils.WriteResponse(w, http.StatusOK, newOrderData(order))
+}
+
+// finishStatus sends the refund and the stock release that the status of o
+// calls for and that are not done yet.
+func finishStatus(ctx context.Context, o *repository.Order) error {
+	if (o.Status == StatusCancelled || o.Status == StatusRefunded) && o.UserID != 0 {
+		charged, err := paymentDone(ctx, o.ID, repository.ReasonOrder)
+		if err != nil {
+			return err
+		}
+		refunded, err := paymentDone(ctx, o.ID, repository.ReasonRefund)
+		if err != nil {
+			return err
+		}
+		if charged && !refunded {
+			if err := refund(ctx, *o); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !holdsStock(o.Status) {
+		held, err := holdsReservation(ctx, o)
+		if err != nil {
+			return err
+		}
+		if held {
+			return releaseStock(ctx, o)
+		}
+	}
+	return nil
+}
+
+// paymentStatus is the status of a payment recorded by the payment service.
+type paymentStatus struct {
+	Status string `json:"status"`
+}
+
+// paymentDone reports whether the payment service made the payment of an order
+// for reason: a payment that succeeded, or was skipped because the user
+// service had already made it.
+func paymentDone(ctx context.Context, orderID int64, reason string) (bool, error) {
+	cursor := ""
+	for {
+		var page datastore.PageResult[paymentStatus]
+		url := fmt.Sprintf("http://%s/payments?order_id=%d&reason=%s&cursor=%s", paymentUrl, orderID, reason, cursor)
+		if err := sendJSON(ctx, http.MethodGet, url, nil, &page); err != nil {
+			return false, fmt.Errorf("list payments error: %w", err)
+		}
+		for _, p := range page.Items {
+			if p.Status == repository.PaymentSucceeded || p.Status == repository.PaymentSkipped {
+				return true, nil
+			}
+		}
+		if page.NextCursor == "" {
+			return false, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// refund gives the price of o back to its user through the payment service.
+func refund(ctx context.Context, o repository.Order) error {
+	ctx, span := tracer.Start(ctx, "refund order")
+	defer span.End()
+
+	if o.UserID == 0 {
+		return gerrors.Newf(gerrors.InvalidTransition, "order %d has no recorded user to refund", o.ID)
+	}
+	return sendPayment(ctx, "refund", o)
+}
+
+type orderPayment struct {
+	Amount  int   `json:"amount"`
+	OrderID int64 `json:"order_id"`
+}
+
+// sendPayment asks the payment service to debit or refund the price of o.
+func sendPayment(ctx context.Context, action string, o repository.Order) error {
+	url := fmt.Sprintf("http://%s/payments/%s/id/%d", paymentUrl, action, o.UserID)
+	if err := sendJSON(ctx, http.MethodPut, url, orderPayment{Amount: o.Price, OrderID: o.ID}, nil); err != nil {
+		return fmt.Errorf("%s payment error: %w", action, err)
+	}
+	return nil
+}
+
+// sendJSON sends request, if not nil, as the JSON body of a request to another
+// service, and reads the JSON body of its response into response, if not nil.
+// A failed response is returned as an error with the matching gerrors code.
+func sendJSON(ctx context.Context, method, url string, request, response interface{}) error {
+	var payload []byte
+	if request != nil {
+		var err error
+		if payload, err = json.Marshal(request); err != nil {
+			return fmt.Errorf("marshal request error: %w", err)
+		}
+	}
+
+	resp, err := utils.SendRequest(ctx, method, url, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return utils.ResponseError(resp)
+	}
+	if response != nil {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			return fmt.Errorf("decode response error: %w", err)
+		}
+	}
+	return nil
+}
+
+func readOrderFilter(r *http.Request) (repository.OrderFilter, error) {
+	query := r.URL.Query()
+	filter := repository.OrderFilter{Status: query.Get("status")}
+
+	var err error
+	if v := query.Get("user_id"); v != "" {
+		if filter.UserID, err = parseID("user", v); err != nil {
+			return filter, err
+		}
+	}
+	if v := query.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, gerrors.Newf(gerrors.BadRequest, "invalid from %q: must be an RFC 3339 time", v)
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, gerrors.Newf(gerrors.BadRequest, "invalid to %q: must be an RFC 3339 time", v)
+		}
+	}
+	return filter, nil
+}
+
+// parseID validates an ID parameter of a request.
+func parseID(kind, id string) (int64, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, gerrors.Newf(gerrors.BadRequest, "invalid %s id %q: must be a positive number", kind, id)
+	}
+	return n, nil
 }
@@ -0,0 +1,92 @@
+package payment
+
+import (
+	"context"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+)
+
+// Card tokens of the fake gateway for the charges to decline, time out or
+// settle late. Any other token is approved.
+const (
+	TokenDeclined = "tok_declined"
+	TokenTimeout  = "tok_timeout"
+	TokenDelayed  = "tok_delayed"
+)
+
+// fakeGateway is a local Gateway simulating the outcomes of a processor. A
+// charge is declined or times out when it is authorized, and a delayed
+// settlement makes its capture slow. Every call takes latency.
+type fakeGateway struct {
+	latency         time.Duration
+	timeout         time.Duration
+	settlementDelay time.Duration
+	// thresholds of the amounts declined, timed out and settled late, 0 for none.
+	declineOver int
+	timeoutOver int
+	delayOver   int
+}
+
+func newFakeGateway(cnf *config.ServiceConfigurations) fakeGateway {
+	return fakeGateway{
+		latency:         cnf.GatewayLatency,
+		timeout:         cnf.GatewayTimeout,
+		settlementDelay: cnf.GatewaySettlementDelay,
+		declineOver:     cnf.GatewayDeclineOver,
+		timeoutOver:     cnf.GatewayTimeoutOver,
+		delayOver:       cnf.GatewayDelayOver,
+	}
+}
+
+func (g fakeGateway) Authorize(ctx context.Context, c Charge) error {
+	switch {
+	case c.CardToken == TokenTimeout || over(c.Amount, g.timeoutOver):
+		if err := wait(ctx, g.timeout); err != nil {
+			return err
+		}
+		return gerrors.Newf(gerrors.GatewayTimeout, "payment %s timed out", c.Reference)
+	case c.CardToken == TokenDeclined || over(c.Amount, g.declineOver):
+		if err := wait(ctx, g.latency); err != nil {
+			return err
+		}
+		return gerrors.Newf(gerrors.PaymentDeclined, "payment %s declined", c.Reference)
+	}
+	return wait(ctx, g.latency)
+}
+
+func (g fakeGateway) Capture(ctx context.Context, c Charge) error {
+	if c.CardToken == TokenDelayed || over(c.Amount, g.delayOver) {
+		return wait(ctx, g.latency+g.settlementDelay)
+	}
+	return wait(ctx, g.latency)
+}
+
+func (g fakeGateway) Void(ctx context.Context, c Charge) error {
+	return wait(ctx, g.latency)
+}
+
+func (g fakeGateway) Refund(ctx context.Context, c Charge) error {
+	return wait(ctx, g.latency)
+}
+
+func over(amount, threshold int) bool {
+	return threshold > 0 && amount > threshold
+}
+
+// wait waits for d, or until ctx is done.
+func wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
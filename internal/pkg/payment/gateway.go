@@ -0,0 +1,84 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const GatewayFake = "fake"
+
+// Charge is a payment sent to a gateway. Reference identifies it at the
+// gateway, and is unique per charge, e.g. order-12 for the charge of order 12.
+type Charge struct {
+	Reference string
+	// CardToken stands for the card to charge, empty for the account on file.
+	CardToken string
+	Amount    int
+}
+
+// Gateway is the external processor moving the money of the payments. A charge
+// is authorized first, which holds the amount, then either captured, which
+// settles it, or voided. A captured charge can be refunded.
+//
+// Declined charges fail with a gerrors.PaymentDeclined error and calls the
+// processor did not answer in time with a gerrors.GatewayTimeout error.
+type Gateway interface {
+	Authorize(ctx context.Context, c Charge) error
+	Capture(ctx context.Context, c Charge) error
+	Void(ctx context.Context, c Charge) error
+	Refund(ctx context.Context, c Charge) error
+}
+
+// NewGateway returns the Gateway selected by cnf.PaymentGateway, which records
+// a span per call.
+func NewGateway(cnf *config.ServiceConfigurations) (Gateway, error) {
+	switch cnf.PaymentGateway {
+	case GatewayFake:
+		return tracedGateway{next: newFakeGateway(cnf)}, nil
+	default:
+		return nil, gerrors.Newf(gerrors.ServiceSetup, "unsupported payment gateway %q", cnf.PaymentGateway)
+	}
+}
+
+// tracedGateway records the calls to next as spans.
+type tracedGateway struct {
+	next Gateway
+}
+
+func (g tracedGateway) Authorize(ctx context.Context, c Charge) error {
+	return g.trace(ctx, "authorize", c, g.next.Authorize)
+}
+
+func (g tracedGateway) Capture(ctx context.Context, c Charge) error {
+	return g.trace(ctx, "capture", c, g.next.Capture)
+}
+
+func (g tracedGateway) Void(ctx context.Context, c Charge) error {
+	return g.trace(ctx, "void", c, g.next.Void)
+}
+
+func (g tracedGateway) Refund(ctx context.Context, c Charge) error {
+	return g.trace(ctx, "refund", c, g.next.Refund)
+}
+
+func (g tracedGateway) trace(ctx context.Context, operation string, c Charge, call func(context.Context, Charge) error) error {
+	ctx, span := tracer.Start(ctx, fmt.Sprintf("gateway %s", operation))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("gateway.operation", operation),
+		attribute.String("gateway.reference", c.Reference),
+		attribute.Int("amount", c.Amount),
+	)
+
+	if err := call(ctx, c); err != nil {
+		span.SetStatus(codes.Error, utils.ErrorMessage(err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/repository"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// reconcileBatch bounds the payments reconciled at once.
+const reconcileBatch = 50
+
+// reconcilePayments finishes the payments left pending for staleAfter, every
+// interval until ctx is done.
+func reconcilePayments(ctx context.Context, interval, staleAfter time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		reconcileStale(ctx, staleAfter)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func reconcileStale(ctx context.Context, staleAfter time.Duration) {
+	before := time.Now().Add(-staleAfter)
+	payments, err := store.Payments().ListPending(datastore.WithPrimary(ctx), before, reconcileBatch)
+	if err != nil {
+		log.Printf("list pending payments error: %v", err)
+		return
+	}
+
+	for i := range payments {
+		if err := reconcilePayment(ctx, &payments[i], before); err != nil {
+			log.Printf("reconcile payment %d error: %v", payments[i].ID, err)
+		}
+	}
+}
+
+// reconcilePayment finishes p from the ledger of the user service, which tells
+// whether the balance moved. If it did, p succeeded, once the card is paid
+// back what the balance was debited. If it did not, p failed, once the card is
+// paid back what it was charged. If the gateway fails again, p is left pending
+// for the next round.
+func reconcilePayment(ctx context.Context, p *repository.Payment, before time.Time) error {
+	ctx, span := tracer.Start(ctx, "reconcile payment")
+	defer span.End()
+	span.SetAttributes(attribute.Int64("paymentID", p.ID))
+	ctx = datastore.WithPrimary(ctx)
+
+	// claiming the payment makes another instance reconciling it as well leave it.
+	if err := store.Payments().Claim(ctx, p, before); err != nil {
+		if datastore.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+
+	moved, err := balanceMoved(ctx, *p)
+	if err != nil {
+		span.SetStatus(codes.Error, utils.ErrorMessage(err))
+		return err
+	}
+
+	flow := gatewayFlow(*p)
+	if moved && flow == gatewayPayBack || !moved && flow == gatewayCharge {
+		// the card on file is paid back, the token charged is not recorded.
+		if err := gateway.Refund(ctx, paymentCharge(*p, "")); err != nil {
+			span.SetStatus(codes.Error, utils.ErrorMessage(err))
+			return fmt.Errorf("pay back payment %d error: %w", p.ID, err)
+		}
+	}
+
+	status, reason := repository.PaymentSucceeded, ""
+	if !moved {
+		status, reason = repository.PaymentFailed, "balance not changed"
+	}
+	span.SetAttributes(attribute.String("status", status))
+	if err := store.Payments().Finish(ctx, p, status, reason); err != nil && !datastore.IsConflict(err) {
+		return err
+	}
+	return nil
+}
+
+// balanceMoved reports whether the user service recorded the ledger entries
+// of p.
+func balanceMoved(ctx context.Context, p repository.Payment) (bool, error) {
+	url := fmt.Sprintf("http://%s/users/%d/transactions?payment_id=%d&limit=1", userUrl, p.UserID, p.ID)
+	resp, err := utils.SendRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("list transactions error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, utils.ResponseError(resp)
+	}
+
+	var page datastore.PageResult[struct {
+		ID int64 `json:"id"`
+	}]
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return false, fmt.Errorf("decode transactions error: %w", err)
+	}
+	return len(page.Items) > 0, nil
+}
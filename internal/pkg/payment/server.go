@@ -4,19 +4,26 @@
 package payment
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/health"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/repository"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/utils"
 	"github.com/rs/cors"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 /*
@@ -26,17 +33,32 @@ project         : qt-test-application
 const serviceName = "payment-service"
 
 var (
+	store   repository.Store
 	srv     *http.Server
 	userUrl string
+	gateway Gateway
 	tracer  trace.Tracer
+	ready   health.Readiness
 )
 
 func SetupServer(configurations *config.ServiceConfigurations) {
 	tracer = otel.Tracer(serviceName)
 
+	var err error
+	if gateway, err = NewGateway(configurations); err != nil {
+		log.Fatalf("failed to setup payment gateway: %v", err)
+	}
+
 	router := mux.NewRouter()
 	router.HandleFunc("/payments/transfer/id/{userID}", transferAmount).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/payments/debit/id/{userID}", debitAmount).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/payments/refund/id/{userID}", refundAmount).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/payments/transfers", transferBetweenUsers).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/payments", listPayments).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/payments/{paymentID}", getPayment).Methods(http.MethodGet, http.MethodOptions)
+	ready.Register(router)
 	router.Use(utils.LoggingMW)
+	router.Use(ready.Middleware)
 	router.Use(otelmux.Middleware(serviceName))
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
@@ -56,10 +78,77 @@ func SetupServer(configurations *config.ServiceConfigurations) {
 	}
 }
 
+// InitDB connects to the database in the background. Until it is connected,
+// the service reports not ready instead of exiting. Once connected, it
+// reconciles the payments left pending.
+func InitDB(cnf *config.ServiceConfigurations) {
+	go func() {
+		conn, err := datastore.New(cnf)
+		if err != nil {
+			log.Fatalf("failed to initialize db: %v", err)
+		}
+		store = repository.NewStore(conn)
+		ready.SetReady()
+
+		reconcilePayments(context.Background(), cnf.PaymentReconcileInterval, cnf.PaymentStaleAfter)
+	}()
+}
+
 type paymentData struct {
 	Amount int `json:"amount" validate:"required"`
+	// CardToken is the card charged, or paid back if the amount is negative.
+	CardToken string `json:"card_token,omitempty"`
+	// PaymentID is the payment recorded for the amount, sent to the user service.
+	PaymentID int64 `json:"payment_id,omitempty" validate:"-"`
 }
 
+// payment is a payment recorded by the service.
+type payment struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	OrderID   int64     `json:"order_id,omitempty"`
+	Reason    string    `json:"reason"`
+	Amount    int       `json:"amount"`
+	Direction string    `json:"direction"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newPayment(p repository.Payment) payment {
+	return payment{
+		ID:        p.ID,
+		UserID:    p.UserID,
+		OrderID:   p.OrderID,
+		Reason:    p.Reason,
+		Amount:    p.Amount,
+		Direction: p.Direction,
+		Status:    p.Status,
+		Error:     p.Error,
+		CreatedAt: p.CreatedAt,
+		UpdatedAt: p.UpdatedAt,
+	}
+}
+
+// orderPaymentData is the payment of an order, charged or refunded.
+type orderPaymentData struct {
+	Amount    int    `json:"amount" validate:"required,gt=0"`
+	OrderID   int64  `json:"order_id" validate:"required"`
+	CardToken string `json:"card_token,omitempty"`
+	// PaymentID is the payment recorded for the order, sent to the user service.
+	PaymentID int64 `json:"payment_id,omitempty" validate:"-"`
+}
+
+// userTransferData is an amount moved from a user to another one.
+type userTransferData struct {
+	FromUserID int64 `json:"from_user_id" validate:"required,gt=0"`
+	ToUserID   int64 `json:"to_user_id" validate:"required,gt=0,nefield=FromUserID"`
+	Amount     int   `json:"amount" validate:"required,gt=0"`
+}
+
+// transferAmount credits a user with an amount charged to a card, or pays a
+// negative amount back to the card, and returns the payment recorded.
 func transferAmount(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracer.Start(r.Context(), "transfer amount")
 	defer span.End()
@@ -68,32 +157,396 @@ func transferAmount(w http.ResponseWriter, r *http.Request) {
 	if err := utils.ReadBody(w, r, &data); err != nil {
 		return
 	}
+	span.SetAttributes(attribute.String("userID", userID), attribute.Int("amount", data.Amount))
 
-	payload, err := json.Marshal(data)
+	id, err := parseID("user", userID)
 	if err != nil {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, err)
 		return
 	}
 
+	p := repository.Payment{UserID: id, Reason: repository.ReasonPayment, Amount: data.Amount, Direction: repository.PaymentCredit}
+	if data.Amount < 0 {
+		p.Amount, p.Direction = -data.Amount, repository.PaymentDebit
+	}
+
 	// send the request to user service
-	url := fmt.Sprintf("http://%s/users/%s", userUrl, userID)
-	resp, err := utils.SendRequest(ctx, http.MethodPut, url, payload)
+	url := fmt.Sprintf("http://%s/users/%d", userUrl, id)
+	if err := recordPayments(ctx, []*repository.Payment{&p}, data.CardToken, func() (bool, error) {
+		return sendToUser(ctx, url, paymentData{Amount: data.Amount, PaymentID: p.ID})
+	}); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	utils.WriteResponse(w, http.StatusOK, newPayment(p))
+}
+
+func getPayment(w http.ResponseWriter, r *http.Request) {
+	paymentID := mux.Vars(r)["paymentID"]
+
+	ctx, span := tracer.Start(r.Context(), "get payment")
+	defer span.End()
+	span.SetAttributes(attribute.String("paymentID", paymentID))
+
+	id, err := parseID("payment", paymentID)
 	if err != nil {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, err)
 		return
 	}
 
-	b, err := ioutil.ReadAll(resp.Body)
+	stored, err := store.Payments().Get(ctx, id)
 	if err != nil {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, err)
+		utils.WriteError(w, err)
 		return
 	}
+
+	utils.WriteResponse(w, http.StatusOK, newPayment(stored))
+}
+
+// listPayments lists the payments of the user or of the order given by the
+// query parameters user_id and order_id, at least one of which is required,
+// with the given reason if any. The query parameters limit and cursor select
+// the page.
+func listPayments(w http.ResponseWriter, r *http.Request) {
+	page, err := datastore.ReadPage(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	userID, orderID := query.Get("user_id"), query.Get("order_id")
+	if userID == "" && orderID == "" {
+		utils.WriteError(w, gerrors.New(gerrors.BadRequest, "user_id or order_id is required"))
+		return
+	}
+	f := repository.PaymentFilter{Reason: query.Get("reason")}
+	if userID != "" {
+		if f.UserID, err = parseID("user", userID); err != nil {
+			utils.WriteError(w, err)
+			return
+		}
+	}
+	if orderID != "" {
+		if f.OrderID, err = parseID("order", orderID); err != nil {
+			utils.WriteError(w, err)
+			return
+		}
+	}
+
+	ctx, span := tracer.Start(r.Context(), "list payments")
+	defer span.End()
+	span.SetAttributes(attribute.Int64("userID", f.UserID), attribute.Int64("orderID", f.OrderID), attribute.String("reason", f.Reason))
+
+	payments, err := store.Payments().List(ctx, f, page)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	response := datastore.PageResult[payment]{Items: make([]payment, 0, len(payments.Items)), NextCursor: payments.NextCursor}
+	for _, p := range payments.Items {
+		response.Items = append(response.Items, newPayment(p))
+	}
+	utils.WriteResponse(w, http.StatusOK, response)
+}
+
+// transferBetweenUsers moves an amount from the balance of a user to another
+// one, and returns the debit and the credit recorded. The money stays on the
+// balances, so nothing goes through the gateway. Transfers of a user to itself
+// and non-positive amounts are rejected before anything is recorded; the user
+// service, which owns the balances, moves the amount in one transaction and
+// rejects insufficient funds.
+func transferBetweenUsers(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "transfer between users")
+	defer span.End()
+	var data userTransferData
+	if err := utils.ReadBody(w, r, &data); err != nil {
+		return
+	}
+	span.SetAttributes(
+		attribute.Int64("fromUserID", data.FromUserID),
+		attribute.Int64("toUserID", data.ToUserID),
+		attribute.Int("amount", data.Amount),
+	)
+
+	debit := repository.Payment{UserID: data.FromUserID, Reason: repository.ReasonTransfer, Amount: data.Amount, Direction: repository.PaymentDebit}
+	credit := repository.Payment{UserID: data.ToUserID, Reason: repository.ReasonTransfer, Amount: data.Amount, Direction: repository.PaymentCredit}
+	url := fmt.Sprintf("http://%s/users/%d/transfer", userUrl, data.FromUserID)
+	if err := recordPayments(ctx, []*repository.Payment{&debit, &credit}, "", func() (bool, error) {
+		return sendToUser(ctx, url, struct {
+			ToUserID        int64 `json:"to_user_id"`
+			Amount          int   `json:"amount"`
+			DebitPaymentID  int64 `json:"debit_payment_id"`
+			CreditPaymentID int64 `json:"credit_payment_id"`
+		}{data.ToUserID, data.Amount, debit.ID, credit.ID})
+	}); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	utils.WriteResponse(w, http.StatusOK, struct {
+		Debit  payment `json:"debit"`
+		Credit payment `json:"credit"`
+	}{newPayment(debit), newPayment(credit)})
+}
+
+// debitAmount charges the price of an order to the user.
+func debitAmount(w http.ResponseWriter, r *http.Request) {
+	orderPayment(w, r, "debit amount", "debit", repository.ReasonOrder, repository.PaymentDebit)
+}
+
+// refundAmount gives the price of an order back to the user.
+func refundAmount(w http.ResponseWriter, r *http.Request) {
+	orderPayment(w, r, "refund amount", "refund", repository.ReasonRefund, repository.PaymentCredit)
+}
+
+// orderPayment sends the payment of an order to the given balance endpoint of
+// the user service, through the gateway, passing its error status on, and
+// returns the payment recorded. A payment of the order for the reason already
+// done is returned as is, without sending it again.
+func orderPayment(w http.ResponseWriter, r *http.Request, spanName, action, reason, direction string) {
+	ctx, span := tracer.Start(r.Context(), spanName)
+	defer span.End()
+	userID := mux.Vars(r)["userID"]
+	var data orderPaymentData
+	if err := utils.ReadBody(w, r, &data); err != nil {
+		return
+	}
+	span.SetAttributes(attribute.String("userID", userID), attribute.Int64("orderID", data.OrderID))
+
+	id, err := parseID("user", userID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	done, found, err := store.Payments().FindDone(ctx, data.OrderID, reason)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	if found {
+		utils.WriteResponse(w, http.StatusOK, newPayment(done))
+		return
+	}
+
+	p := repository.Payment{UserID: id, OrderID: data.OrderID, Reason: reason, Amount: data.Amount, Direction: direction}
+	url := fmt.Sprintf("http://%s/users/%d/%s", userUrl, id, action)
+	if err := recordPayments(ctx, []*repository.Payment{&p}, data.CardToken, func() (bool, error) {
+		return sendToUser(ctx, url, orderPaymentData{Amount: data.Amount, OrderID: data.OrderID, PaymentID: p.ID})
+	}); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	utils.WriteResponse(w, http.StatusOK, newPayment(p))
+}
+
+// finishTimeout bounds the recording of how a payment ended.
+const finishTimeout = 5 * time.Second
+
+// recordPayments records payments pending, in one transaction, then makes
+// them: apply moves the balances and the first payment moves the money at the
+// gateway, charging cardToken, see gatewayFlow. How they ended is recorded:
+// SUCCEEDED, SKIPPED if apply reported the balances unchanged, or FAILED with
+// the error, which is returned. Payments failing with a pendingError are left
+// pending, to be reconciled.
+func recordPayments(ctx context.Context, payments []*repository.Payment, cardToken string, apply func() (bool, error)) error {
+	if err := store.WithTx(ctx, func(tx repository.Store) error {
+		for _, p := range payments {
+			p.Status = repository.PaymentPending
+			if err := tx.Payments().Create(ctx, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("paymentID", payments[0].ID))
+
+	var applied bool
+	p := *payments[0]
+	moveErr := gatewayMove(p)(ctx, paymentCharge(p, cardToken), func() (bool, error) {
+		var err error
+		applied, err = apply()
+		return applied, err
+	})
+
+	var pending pendingError
+	status, reason := repository.PaymentSucceeded, ""
+	switch {
+	case errors.As(moveErr, &pending):
+		for _, p := range payments {
+			log.Printf("payment %d left pending: %v", p.ID, moveErr)
+		}
+		return moveErr
+	case moveErr != nil:
+		status, reason = repository.PaymentFailed, utils.ErrorMessage(moveErr)
+	case !applied:
+		status = repository.PaymentSkipped
+	}
+	// the outcome is recorded even if the client went away meanwhile.
+	ctx, cancel := context.WithTimeout(utils.Detach(ctx), finishTimeout)
+	defer cancel()
+	for _, p := range payments {
+		if err := store.Payments().Finish(ctx, p, status, reason); err != nil {
+			// the payment stays pending until it is reconciled.
+			log.Printf("finish payment %d error: %v", p.ID, err)
+		}
+	}
+	return moveErr
+}
+
+// How the money of a payment moves at the gateway.
+const (
+	// gatewayNone: transfers between users stay on the balances.
+	gatewayNone = iota
+	// gatewayCharge: the card is charged before the balance moves.
+	gatewayCharge
+	// gatewayPayBack: the card is paid back once the balance moved.
+	gatewayPayBack
+)
+
+// gatewayFlow returns how the money of p moves at the gateway: a card pays for
+// the credits of a payment and for the orders, and is paid back the debits of
+// a payment and the refunds.
+func gatewayFlow(p repository.Payment) int {
+	switch {
+	case p.Reason == repository.ReasonTransfer:
+		return gatewayNone
+	case p.Reason == repository.ReasonOrder, p.Reason == repository.ReasonPayment && p.Direction == repository.PaymentCredit:
+		return gatewayCharge
+	default:
+		return gatewayPayBack
+	}
+}
+
+// gatewayMove returns the function moving the money of p at the gateway around
+// apply, which moves the balance.
+func gatewayMove(p repository.Payment) func(ctx context.Context, c Charge, apply func() (bool, error)) error {
+	switch gatewayFlow(p) {
+	case gatewayCharge:
+		return chargeGateway
+	case gatewayPayBack:
+		return refundGateway
+	default:
+		return func(ctx context.Context, c Charge, apply func() (bool, error)) error {
+			_, err := apply()
+			return err
+		}
+	}
+}
+
+// paymentCharge returns the charge of p at the gateway. The payments of an
+// order share its reference.
+func paymentCharge(p repository.Payment, cardToken string) Charge {
+	reference := fmt.Sprintf("payment-%d", p.ID)
+	if p.OrderID != 0 {
+		reference = fmt.Sprintf("order-%d", p.OrderID)
+	}
+	return Charge{Reference: reference, CardToken: cardToken, Amount: p.Amount}
+}
+
+// pendingError is the error of a payment that cannot be finished yet: the
+// balance of the user moved, or may have moved, and the gateway is not done
+// with the payment. Such a payment is neither succeeded nor failed.
+type pendingError struct {
+	err error
+}
+
+func (e pendingError) Error() string {
+	return e.err.Error()
+}
+
+func (e pendingError) Unwrap() error {
+	return e.err
+}
+
+// chargeGateway charges c through the gateway before apply, which moves the
+// amount on the balance of the user and reports whether it did: c is
+// authorized and captured, so that the balance only moves once the money is
+// settled, then paid back if apply did not move the amount, e.g. if the order
+// was already charged.
+func chargeGateway(ctx context.Context, c Charge, apply func() (bool, error)) error {
+	if err := gateway.Authorize(ctx, c); err != nil {
+		return err
+	}
+	if err := gateway.Capture(ctx, c); err != nil {
+		if voidErr := gateway.Void(ctx, c); voidErr != nil {
+			log.Printf("void payment %s error: %v", c.Reference, voidErr)
+		}
+		return err
+	}
+
+	applied, err := apply()
+	var pending pendingError
+	if errors.As(err, &pending) {
+		// the amount may have moved: it is kept until that is known.
+		return err
+	}
+	if err != nil || !applied {
+		if refundErr := gateway.Refund(ctx, c); refundErr != nil {
+			return pendingError{fmt.Errorf("pay back payment %s error: %w", c.Reference, refundErr)}
+		}
+		return err
+	}
+	return nil
+}
+
+// refundGateway pays c back through the gateway once apply, which moves the
+// amount on the balance of the user, did move it. Nothing is paid back if it
+// did not, e.g. if the order was already refunded or never charged.
+func refundGateway(ctx context.Context, c Charge, apply func() (bool, error)) error {
+	applied, err := apply()
+	if err != nil || !applied {
+		return err
+	}
+	if err := gateway.Refund(ctx, c); err != nil {
+		// the balance moved, the payment did not fail.
+		return pendingError{err}
+	}
+	return nil
+}
+
+// sendToUser sends data to a balance endpoint of the user service, and
+// reports whether the balance changed: the user service skips the changes it
+// already made. Its error status is returned as an error with the matching
+// gerrors code, and a missing answer as a pendingError: the balance may have
+// changed.
+func sendToUser(ctx context.Context, url string, data interface{}) (bool, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return false, fmt.Errorf("marshal payment error: %w", err)
+	}
+
+	resp, err := utils.SendRequest(ctx, http.MethodPut, url, payload)
+	if err != nil {
+		return false, pendingError{fmt.Errorf("send payment error: %w", err)}
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		utils.WriteErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("payment failed. got response: %s", b))
-		return
+		return false, utils.ResponseError(resp)
+	}
+
+	var change struct {
+		Applied bool `json:"applied"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&change); err != nil {
+		return false, pendingError{fmt.Errorf("decode payment response error: %w", err)}
 	}
+	return change.Applied, nil
+}
 
-	utils.WriteResponse(w, http.StatusOK, data)
+// parseID validates an ID parameter of a request.
+func parseID(kind, id string) (int64, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, gerrors.Newf(gerrors.BadRequest, "invalid %s id %q: must be a positive number", kind, id)
+	}
+	return n, nil
 }
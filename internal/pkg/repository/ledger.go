@@ -0,0 +1,179 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+)
+
+// System accounts, on the other side of the entries of users.
+const (
+	// AccountPayments is where the money credited by the payment service comes from.
+	AccountPayments = "payments"
+	// AccountSales receives the money paid for orders.
+	AccountSales = "sales"
+)
+
+const (
+	ReasonPayment  = "payment"
+	ReasonOrder    = "order"
+	ReasonRefund   = "refund"
+	ReasonTransfer = "transfer"
+)
+
+// LedgerEntry is one leg of a movement of money. The entries of a movement sum
+// to zero: what an account is credited, another one is debited.
+type LedgerEntry struct {
+	ID int64
+	// UserID is 0 for the entries of system accounts.
+	UserID  int64
+	Account string
+	Amount  int
+	Reason  string
+	// OrderID and PaymentID reference what caused the movement, 0 if nothing.
+	OrderID   int64
+	PaymentID int64
+	CreatedAt time.Time
+}
+
+// LedgerFilter selects the entries of a user. A zero PaymentID does not filter.
+type LedgerFilter struct {
+	UserID    int64
+	PaymentID int64
+}
+
+type LedgerRepository interface {
+	// Post records entries as one movement. They must sum to zero.
+	Post(ctx context.Context, entries ...LedgerEntry) error
+	// List returns the entries of a user selected by f, oldest first.
+	List(ctx context.Context, f LedgerFilter, page datastore.Page) (datastore.PageResult[LedgerEntry], error)
+	// Balance returns the sum of the entries of a user, which User.Amount caches.
+	Balance(ctx context.Context, userID int64) (int, error)
+	// HasOrderEntry reports whether the user has an entry for the reason about
+	// the order.
+	HasOrderEntry(ctx context.Context, userID, orderID int64, reason string) (bool, error)
+}
+
+// DoubleEntry returns the entries moving amount from the system account
+// counter to u, or from u to counter if amount is negative. Both take the
+// reason and references of base.
+func DoubleEntry(base LedgerEntry, u User, counter string, amount int) []LedgerEntry {
+	user, system := base, base
+	user.UserID, user.Account, user.Amount = u.ID, u.Account, amount
+	system.UserID, system.Account, system.Amount = 0, counter, -amount
+	return []LedgerEntry{user, system}
+}
+
+// ledgerRepository runs its queries on q, which is either the DB or a transaction.
+// Posting several entries is only atomic in a transaction.
+type ledgerRepository struct {
+	q datastore.Tx
+}
+
+func (r ledgerRepository) Post(ctx context.Context, entries ...LedgerEntry) error {
+	sum := 0
+	for _, e := range entries {
+		sum += e.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("unbalanced ledger entries: sum is %d", sum)
+	}
+
+	now := time.Now().UTC()
+	for _, e := range entries {
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = now
+		}
+		if _, err := r.q.InsertOne(ctx, datastore.InsertParams{
+			Query: `insert into LEDGER_ENTRIES(USER_ID, ACCOUNT, AMOUNT, REASON, ORDER_ID, PAYMENT_ID, CREATED_AT) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			Vars:  []interface{}{e.UserID, e.Account, e.Amount, e.Reason, nullID(e.OrderID), nullID(e.PaymentID), e.CreatedAt},
+		}); err != nil {
+			return fmt.Errorf("post ledger entry error: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (r ledgerRepository) List(ctx context.Context, f LedgerFilter, page datastore.Page) (datastore.PageResult[LedgerEntry], error) {
+	where := "USER_ID = ? and ID > ?"
+	filters := []interface{}{f.UserID, page.AfterID()}
+	if f.PaymentID != 0 {
+		where += " and PAYMENT_ID = ?"
+		filters = append(filters, f.PaymentID)
+	}
+
+	var entries []LedgerEntry
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		Query: `select ID, USER_ID, ACCOUNT, AMOUNT, REASON, ORDER_ID, PAYMENT_ID, CREATED_AT from LEDGER_ENTRIES
+			where ` + where + ` order by ID limit ?`,
+		Filters: append(filters, page.Fetch()),
+		Scan: func(row datastore.Scanner) error {
+			var (
+				e                  LedgerEntry
+				orderID, paymentID sql.NullInt64
+			)
+			if err := row.Scan(&e.ID, &e.UserID, &e.Account, &e.Amount, &e.Reason, &orderID, &paymentID, &e.CreatedAt); err != nil {
+				return err
+			}
+			e.OrderID, e.PaymentID = orderID.Int64, paymentID.Int64
+			entries = append(entries, e)
+			return nil
+		},
+	}); err != nil {
+		return datastore.PageResult[LedgerEntry]{}, fmt.Errorf("list ledger entries error: %w", err)
+	}
+
+	return datastore.Paginate(page, entries, func(e LedgerEntry) datastore.Cursor {
+		return datastore.Cursor{ID: e.ID}
+	}), nil
+}
+
+func (r ledgerRepository) Balance(ctx context.Context, userID int64) (int, error) {
+	// summed here rather than in SQL, which the memory driver does not aggregate.
+	balance := 0
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		Query:   `select AMOUNT from LEDGER_ENTRIES where USER_ID = ?`,
+		Filters: []interface{}{userID},
+		Scan: func(row datastore.Scanner) error {
+			var amount int
+			if err := row.Scan(&amount); err != nil {
+				return err
+			}
+			balance += amount
+			return nil
+		},
+	}); err != nil {
+		return 0, fmt.Errorf("sum ledger entries error: %w", err)
+	}
+
+	return balance, nil
+}
+
+func (r ledgerRepository) HasOrderEntry(ctx context.Context, userID, orderID int64, reason string) (bool, error) {
+	var id int64
+	err := r.q.SelectOne(ctx, datastore.SelectParams{
+		Query:   `select ID from LEDGER_ENTRIES where USER_ID = ? and ORDER_ID = ? and REASON = ? limit 1`,
+		Filters: []interface{}{userID, orderID, reason},
+		Result:  []interface{}{&id},
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("find ledger entry error: %w", err)
+	}
+	return true, nil
+}
+
+// nullID stores a missing reference as NULL.
+func nullID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
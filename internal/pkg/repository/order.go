@@ -0,0 +1,183 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+)
+
+// OrderFilter selects the orders of a list. Zero fields do not filter.
+type OrderFilter struct {
+	UserID int64
+	Status string
+	// From and To bound the creation time of the orders, From included and To excluded.
+	From time.Time
+	To   time.Time
+}
+
+const orderColumns = `ID, USER_ID, ACCOUNT, PRODUCT_NAME, PRICE, ORDER_STATUS, CREATED_AT`
+
+// orderRepository runs its queries on q, which is either the DB or a transaction.
+type orderRepository struct {
+	q datastore.Tx
+}
+
+func (r orderRepository) Create(ctx context.Context, o *Order) error {
+	if o.CreatedAt.IsZero() {
+		o.CreatedAt = time.Now().UTC()
+	}
+
+	id, err := r.q.InsertOne(ctx, datastore.InsertParams{
+		Query: `insert into ORDERS(USER_ID, ACCOUNT, PRODUCT_NAME, PRICE, ORDER_STATUS, CREATED_AT) VALUES (?, ?, ?, ?, ?, ?)`,
+		Vars:  []interface{}{o.UserID, o.Account, o.ProductName, o.Price, o.Status, o.CreatedAt},
+	})
+	if err != nil {
+		return fmt.Errorf("create order error: %w", err)
+	}
+
+	o.ID = id
+	for i := range o.Items {
+		item := &o.Items[i]
+		item.OrderID = id
+		if item.ID, err = r.q.InsertOne(ctx, datastore.InsertParams{
+			Query: `insert into ORDER_ITEMS(ORDER_ID, PRODUCT_ID, PRODUCT_NAME, UNIT_PRICE, QUANTITY) VALUES (?, ?, ?, ?, ?)`,
+			Vars:  []interface{}{item.OrderID, item.ProductID, item.ProductName, item.UnitPrice, item.Quantity},
+		}); err != nil {
+			return fmt.Errorf("create order item error: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r orderRepository) Get(ctx context.Context, id int64) (Order, error) {
+	var (
+		o    Order
+		scan orderScan
+	)
+	if err := r.q.SelectOne(ctx, datastore.SelectParams{
+		Query:   `select ` + orderColumns + ` from ORDERS where ID = ?`,
+		Filters: []interface{}{id},
+		Result:  scan.dest(&o),
+	}); err != nil {
+		return Order{}, notFound(err, "order %d not found", id)
+	}
+	scan.apply(&o)
+
+	orders := []Order{o}
+	if err := r.loadItems(ctx, orders); err != nil {
+		return Order{}, err
+	}
+	return orders[0], nil
+}
+
+func (r orderRepository) List(ctx context.Context, f OrderFilter, page datastore.Page) (datastore.PageResult[Order], error) {
+	where := []string{"ID > ?"}
+	filters := []interface{}{page.AfterID()}
+	if f.UserID != 0 {
+		where = append(where, "USER_ID = ?")
+		filters = append(filters, f.UserID)
+	}
+	if f.Status != "" {
+		where = append(where, "ORDER_STATUS = ?")
+		filters = append(filters, f.Status)
+	}
+	if !f.From.IsZero() {
+		where = append(where, "CREATED_AT >= ?")
+		filters = append(filters, f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		where = append(where, "CREATED_AT < ?")
+		filters = append(filters, f.To.UTC())
+	}
+
+	var orders []Order
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		Query:   `select ` + orderColumns + ` from ORDERS where ` + strings.Join(where, " and ") + ` order by ID limit ?`,
+		Filters: append(filters, page.Fetch()),
+		Scan: func(row datastore.Scanner) error {
+			var (
+				o    Order
+				scan orderScan
+			)
+			if err := row.Scan(scan.dest(&o)...); err != nil {
+				return err
+			}
+			scan.apply(&o)
+			orders = append(orders, o)
+			return nil
+		},
+	}); err != nil {
+		return datastore.PageResult[Order]{}, fmt.Errorf("list orders error: %w", err)
+	}
+	if err := r.loadItems(ctx, orders); err != nil {
+		return datastore.PageResult[Order]{}, err
+	}
+
+	return datastore.Paginate(page, orders, func(o Order) datastore.Cursor {
+		return datastore.Cursor{ID: o.ID}
+	}), nil
+}
+
+func (r orderRepository) UpdateStatus(ctx context.Context, o *Order, status string) error {
+	if err := r.q.UpdateOne(ctx, datastore.UpdateParams{
+		Query:       `update ORDERS set ORDER_STATUS = ? where ID = ? and ORDER_STATUS = ?`,
+		Vars:        []interface{}{status, o.ID, o.Status},
+		Conditional: true,
+	}); err != nil {
+		return fmt.Errorf("update order status error: %w", err)
+	}
+
+	o.Status = status
+	return nil
+}
+
+// loadItems sets the items of orders, with one query for all of them.
+func (r orderRepository) loadItems(ctx context.Context, orders []Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	index := make(map[int64]int, len(orders))
+	ids := make([]interface{}, 0, len(orders))
+	for i, o := range orders {
+		index[o.ID] = i
+		ids = append(ids, o.ID)
+	}
+
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		Query: `select ID, ORDER_ID, PRODUCT_ID, PRODUCT_NAME, UNIT_PRICE, QUANTITY from ORDER_ITEMS
+			where ORDER_ID in (?` + strings.Repeat(", ?", len(ids)-1) + `) order by ID`,
+		Filters: ids,
+		Scan: func(row datastore.Scanner) error {
+			var item OrderItem
+			if err := row.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.ProductName, &item.UnitPrice, &item.Quantity); err != nil {
+				return err
+			}
+			o := &orders[index[item.OrderID]]
+			o.Items = append(o.Items, item)
+			return nil
+		},
+	}); err != nil {
+		return fmt.Errorf("list order items error: %w", err)
+	}
+	return nil
+}
+
+// orderScan reads the columns that are NULL for the orders created before
+// they were added.
+type orderScan struct {
+	userID    sql.NullInt64
+	createdAt sql.NullTime
+}
+
+func (s *orderScan) dest(o *Order) []interface{} {
+	return []interface{}{&o.ID, &s.userID, &o.Account, &o.ProductName, &o.Price, &o.Status, &s.createdAt}
+}
+
+func (s *orderScan) apply(o *Order) {
+	o.UserID, o.CreatedAt = s.userID.Int64, s.createdAt.Time
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+)
+
+// BenchmarkCreateOrder inserts an order with its items and its saga in a
+// transaction, as the order service does when placing it, with and without
+// the prepared statement cache.
+func BenchmarkCreateOrder(b *testing.B) {
+	for _, bc := range []struct {
+		name          string
+		stmtCacheSize int
+	}{
+		{name: "without stmt cache", stmtCacheSize: 0},
+		{name: "with stmt cache", stmtCacheSize: 100},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cnf, err := config.GetServiceConfigurations()
+			if err != nil {
+				b.Fatalf("get configurations: %v", err)
+			}
+			cnf.DBDriver = datastore.DriverSQLite
+			cnf.SqlitePath = ":memory:"
+			cnf.SqlStmtCacheSize = bc.stmtCacheSize
+
+			db, err := datastore.New(cnf)
+			if err != nil {
+				b.Fatalf("new db: %v", err)
+			}
+			defer db.Close()
+			store := NewStore(db)
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				o := Order{
+					UserID:      1,
+					Account:     "bench",
+					ProductName: "pen, ink",
+					Price:       12,
+					Status:      "PENDING",
+					Items: []OrderItem{
+						{ProductID: 1, ProductName: "pen", UnitPrice: 5, Quantity: 2},
+						{ProductID: 2, ProductName: "ink", UnitPrice: 2, Quantity: 1},
+					},
+				}
+				if err := store.WithTx(ctx, func(tx Store) error {
+					if err := tx.Orders().Create(ctx, &o); err != nil {
+						return err
+					}
+					return tx.Sagas().Create(ctx, &Saga{OrderID: o.ID, Step: 1, Status: SagaRunning})
+				}); err != nil {
+					b.Fatalf("create order: %v", err)
+				}
+			}
+		})
+	}
+}
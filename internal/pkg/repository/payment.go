@@ -0,0 +1,241 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+)
+
+// Payment directions, seen from the user: a credit is added to the balance of
+// the user, a debit is taken from it.
+const (
+	PaymentCredit = "credit"
+	PaymentDebit  = "debit"
+)
+
+// Payment statuses. A payment is PENDING until the gateway and the user
+// service are done with it. SUCCEEDED, SKIPPED and FAILED are final: a payment
+// is SKIPPED if the user service found the change already made, e.g. an order
+// debited again, or nothing to do, e.g. a refund of an order never charged.
+const (
+	PaymentPending   = "PENDING"
+	PaymentSucceeded = "SUCCEEDED"
+	PaymentSkipped   = "SKIPPED"
+	PaymentFailed    = "FAILED"
+)
+
+// Payment is a movement of money on the balance of a user, made by the
+// payment service. Reason is one of the reasons of the ledger entries.
+type Payment struct {
+	ID     int64
+	UserID int64
+	// OrderID is the order paid or refunded, 0 if none.
+	OrderID int64
+	Reason  string
+	// Amount is positive, Direction tells which way it moves.
+	Amount    int
+	Direction string
+	Status    string
+	// Error is the reason a FAILED payment failed.
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// PaymentFilter selects the payments of a list. Zero fields do not filter.
+type PaymentFilter struct {
+	UserID  int64
+	OrderID int64
+	Reason  string
+}
+
+type PaymentRepository interface {
+	// Create inserts p and sets its ID.
+	Create(ctx context.Context, p *Payment) error
+	Get(ctx context.Context, id int64) (Payment, error)
+	// List returns the payments selected by f, oldest first.
+	List(ctx context.Context, f PaymentFilter, page datastore.Page) (datastore.PageResult[Payment], error)
+	// FindDone returns the payment of an order for the reason that succeeded
+	// or was skipped, and reports whether there is one.
+	FindDone(ctx context.Context, orderID int64, reason string) (Payment, bool, error)
+	// Finish sets the final status of p, and fails with a gerrors.Conflict
+	// error if p is no longer pending.
+	Finish(ctx context.Context, p *Payment, status, reason string) error
+	// ListPending returns at most limit payments that are still pending and
+	// were last updated before before, oldest first.
+	ListPending(ctx context.Context, before time.Time, limit int) ([]Payment, error)
+	// Claim touches p if it is still pending and was last updated before
+	// before, and fails with a gerrors.Conflict error otherwise, e.g. if
+	// another instance claimed it first.
+	Claim(ctx context.Context, p *Payment, before time.Time) error
+}
+
+const paymentColumns = `ID, USER_ID, ORDER_ID, REASON, AMOUNT, DIRECTION, STATUS, ERROR, CREATED_AT, UPDATED_AT`
+
+// paymentScan holds the nullable columns of a payment while it is scanned.
+type paymentScan struct {
+	orderID    sql.NullInt64
+	paymentErr sql.NullString
+}
+
+func (s *paymentScan) dest(p *Payment) []interface{} {
+	return []interface{}{&p.ID, &p.UserID, &s.orderID, &p.Reason, &p.Amount, &p.Direction, &p.Status, &s.paymentErr, &p.CreatedAt, &p.UpdatedAt}
+}
+
+func (s *paymentScan) apply(p *Payment) {
+	p.OrderID, p.Error = s.orderID.Int64, s.paymentErr.String
+}
+
+// paymentRepository runs its queries on q, which is either the DB or a transaction.
+type paymentRepository struct {
+	q datastore.Tx
+}
+
+func (r paymentRepository) Create(ctx context.Context, p *Payment) error {
+	now := time.Now().UTC()
+	p.CreatedAt, p.UpdatedAt = now, now
+
+	id, err := r.q.InsertOne(ctx, datastore.InsertParams{
+		Query: `insert into PAYMENTS(USER_ID, ORDER_ID, REASON, AMOUNT, DIRECTION, STATUS, ERROR, CREATED_AT, UPDATED_AT) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		Vars:  []interface{}{p.UserID, nullID(p.OrderID), p.Reason, p.Amount, p.Direction, p.Status, nullString(p.Error), p.CreatedAt, p.UpdatedAt},
+	})
+	if err != nil {
+		return fmt.Errorf("create payment error: %w", err)
+	}
+
+	p.ID = id
+	return nil
+}
+
+func (r paymentRepository) Get(ctx context.Context, id int64) (Payment, error) {
+	var (
+		p    Payment
+		scan paymentScan
+	)
+	if err := r.q.SelectOne(ctx, datastore.SelectParams{
+		Query:   `select ` + paymentColumns + ` from PAYMENTS where ID = ?`,
+		Filters: []interface{}{id},
+		Result:  scan.dest(&p),
+	}); err != nil {
+		return Payment{}, notFound(err, "payment %d not found", id)
+	}
+
+	scan.apply(&p)
+	return p, nil
+}
+
+func (r paymentRepository) List(ctx context.Context, f PaymentFilter, page datastore.Page) (datastore.PageResult[Payment], error) {
+	where := []string{"ID > ?"}
+	filters := []interface{}{page.AfterID()}
+	if f.UserID != 0 {
+		where = append(where, "USER_ID = ?")
+		filters = append(filters, f.UserID)
+	}
+	if f.OrderID != 0 {
+		where = append(where, "ORDER_ID = ?")
+		filters = append(filters, f.OrderID)
+	}
+	if f.Reason != "" {
+		where = append(where, "REASON = ?")
+		filters = append(filters, f.Reason)
+	}
+
+	var payments []Payment
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		Query:   `select ` + paymentColumns + ` from PAYMENTS where ` + strings.Join(where, " and ") + ` order by ID limit ?`,
+		Filters: append(filters, page.Fetch()),
+		Scan:    scanPayments(&payments),
+	}); err != nil {
+		return datastore.PageResult[Payment]{}, fmt.Errorf("list payments error: %w", err)
+	}
+
+	return datastore.Paginate(page, payments, func(p Payment) datastore.Cursor {
+		return datastore.Cursor{ID: p.ID}
+	}), nil
+}
+
+func (r paymentRepository) FindDone(ctx context.Context, orderID int64, reason string) (Payment, bool, error) {
+	var (
+		p    Payment
+		scan paymentScan
+	)
+	err := r.q.SelectOne(ctx, datastore.SelectParams{
+		Query: `select ` + paymentColumns + ` from PAYMENTS
+			where ORDER_ID = ? and REASON = ? and STATUS in (?, ?) order by ID limit 1`,
+		Filters: []interface{}{orderID, reason, PaymentSucceeded, PaymentSkipped},
+		Result:  scan.dest(&p),
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return Payment{}, false, nil
+	}
+	if err != nil {
+		return Payment{}, false, fmt.Errorf("find payment error: %w", err)
+	}
+
+	scan.apply(&p)
+	return p, true, nil
+}
+
+func (r paymentRepository) Finish(ctx context.Context, p *Payment, status, reason string) error {
+	now := time.Now().UTC()
+	if err := r.q.UpdateOne(ctx, datastore.UpdateParams{
+		Query:       `update PAYMENTS set STATUS = ?, ERROR = ?, UPDATED_AT = ? where ID = ? and STATUS = ?`,
+		Vars:        []interface{}{status, nullString(reason), now, p.ID, PaymentPending},
+		Conditional: true,
+	}); err != nil {
+		return fmt.Errorf("finish payment error: %w", err)
+	}
+
+	p.Status, p.Error, p.UpdatedAt = status, reason, now
+	return nil
+}
+
+func (r paymentRepository) ListPending(ctx context.Context, before time.Time, limit int) ([]Payment, error) {
+	var payments []Payment
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		Query: `select ` + paymentColumns + ` from PAYMENTS
+			where STATUS = ? and UPDATED_AT < ? order by ID limit ?`,
+		Filters: []interface{}{PaymentPending, before.UTC(), limit},
+		Scan:    scanPayments(&payments),
+	}); err != nil {
+		return nil, fmt.Errorf("list pending payments error: %w", err)
+	}
+
+	return payments, nil
+}
+
+func (r paymentRepository) Claim(ctx context.Context, p *Payment, before time.Time) error {
+	now := time.Now().UTC()
+	if err := r.q.UpdateOne(ctx, datastore.UpdateParams{
+		Query:       `update PAYMENTS set UPDATED_AT = ? where ID = ? and STATUS = ? and UPDATED_AT < ?`,
+		Vars:        []interface{}{now, p.ID, PaymentPending, before.UTC()},
+		Conditional: true,
+	}); err != nil {
+		return fmt.Errorf("claim payment error: %w", err)
+	}
+
+	p.UpdatedAt = now
+	return nil
+}
+
+// scanPayments returns the Scan function of SelectMany appending the payments
+// read to payments.
+func scanPayments(payments *[]Payment) func(row datastore.Scanner) error {
+	return func(row datastore.Scanner) error {
+		var (
+			p    Payment
+			scan paymentScan
+		)
+		if err := row.Scan(scan.dest(&p)...); err != nil {
+			return err
+		}
+		scan.apply(&p)
+		*payments = append(*payments, p)
+		return nil
+	}
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+)
+
+// testDBs numbers the databases of the tests, memory ones outlive the test.
+var testDBs int64
+
+// newTestStore returns a store on an empty database of driver.
+func newTestStore(t testing.TB, driver string) Store {
+	cnf, err := config.GetServiceConfigurations()
+	if err != nil {
+		t.Fatalf("get configurations: %v", err)
+	}
+	cnf.DBDriver = driver
+	cnf.SqlDB = fmt.Sprintf("%s-%d", t.Name(), atomic.AddInt64(&testDBs, 1))
+	cnf.SqlitePath = ":memory:"
+
+	db, err := datastore.New(cnf)
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewStore(db)
+}
+
+// TestClaimPayment checks that a stale pending payment is claimed once, and
+// no longer listed as stale once claimed.
+func TestClaimPayment(t *testing.T) {
+	for _, driver := range []string{datastore.DriverMemory, datastore.DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			store := newTestStore(t, driver)
+			ctx := context.Background()
+
+			p := Payment{UserID: 1, Reason: ReasonPayment, Amount: 10, Direction: PaymentCredit, Status: PaymentPending}
+			if err := store.Payments().Create(ctx, &p); err != nil {
+				t.Fatalf("create payment: %v", err)
+			}
+			before := time.Now()
+
+			pending, err := store.Payments().ListPending(ctx, before, 10)
+			if err != nil {
+				t.Fatalf("list pending payments: %v", err)
+			}
+			if len(pending) != 1 || pending[0].ID != p.ID {
+				t.Fatalf("pending payments = %+v, want payment %d", pending, p.ID)
+			}
+
+			if err := store.Payments().Claim(ctx, &pending[0], before); err != nil {
+				t.Fatalf("claim payment: %v", err)
+			}
+			if err := store.Payments().Claim(ctx, &p, before); !datastore.IsConflict(err) {
+				t.Fatalf("claim payment again: got %v, want a conflict", err)
+			}
+			if pending, err = store.Payments().ListPending(ctx, before, 10); err != nil || len(pending) != 0 {
+				t.Fatalf("pending payments after claim = %+v, %v, want none", pending, err)
+			}
+
+			if err := store.Payments().Finish(ctx, &p, PaymentSucceeded, ""); err != nil {
+				t.Fatalf("finish claimed payment: %v", err)
+			}
+		})
+	}
+}
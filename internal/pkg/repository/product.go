@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+)
+
+type Product struct {
+	ID    int64
+	Name  string
+	Price int
+	Stock int
+}
+
+// StockReservation is the quantity of a product taken out of stock for an
+// order. ReleasedAt is zero until the quantity is put back in stock.
+type StockReservation struct {
+	ID         int64
+	OrderID    int64
+	ProductID  int64
+	Quantity   int
+	ReleasedAt time.Time
+}
+
+type ProductRepository interface {
+	// Create inserts p and sets its ID.
+	Create(ctx context.Context, p *Product) error
+	Get(ctx context.Context, id int64) (Product, error)
+	List(ctx context.Context, page datastore.Page) (datastore.PageResult[Product], error)
+	// AddStock adds delta, which may be negative, to the stock of a product.
+	// It fails with a gerrors.OutOfStock error if the stock would go below zero.
+	AddStock(ctx context.Context, id int64, delta int) error
+}
+
+type ReservationRepository interface {
+	// Create inserts res and sets its ID.
+	Create(ctx context.Context, res *StockReservation) error
+	// ListByOrder returns the reservations of an order, released ones included.
+	ListByOrder(ctx context.Context, orderID int64) ([]StockReservation, error)
+	// Release marks res as released.
+	Release(ctx context.Context, res *StockReservation) error
+}
+
+// productRepository runs its queries on q, which is either the DB or a transaction.
+type productRepository struct {
+	q datastore.Tx
+}
+
+func (r productRepository) Create(ctx context.Context, p *Product) error {
+	id, err := r.q.InsertOne(ctx, datastore.InsertParams{
+		Query: `insert into PRODUCTS(NAME, PRICE, STOCK) VALUES (?, ?, ?)`,
+		Vars:  []interface{}{p.Name, p.Price, p.Stock},
+	})
+	if err != nil {
+		return fmt.Errorf("create product error: %w", err)
+	}
+
+	p.ID = id
+	return nil
+}
+
+func (r productRepository) Get(ctx context.Context, id int64) (Product, error) {
+	var p Product
+	if err := r.q.SelectOne(ctx, datastore.SelectParams{
+		Query:   `select ID, NAME, PRICE, STOCK from PRODUCTS where ID = ?`,
+		Filters: []interface{}{id},
+		Result:  []interface{}{&p.ID, &p.Name, &p.Price, &p.Stock},
+	}); err != nil {
+		return Product{}, notFound(err, "product %d not found", id)
+	}
+	return p, nil
+}
+
+func (r productRepository) List(ctx context.Context, page datastore.Page) (datastore.PageResult[Product], error) {
+	var products []Product
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		Query:   `select ID, NAME, PRICE, STOCK from PRODUCTS where ID > ? order by ID limit ?`,
+		Filters: []interface{}{page.AfterID(), page.Fetch()},
+		Scan: func(row datastore.Scanner) error {
+			var p Product
+			if err := row.Scan(&p.ID, &p.Name, &p.Price, &p.Stock); err != nil {
+				return err
+			}
+			products = append(products, p)
+			return nil
+		},
+	}); err != nil {
+		return datastore.PageResult[Product]{}, fmt.Errorf("list products error: %w", err)
+	}
+
+	return datastore.Paginate(page, products, func(p Product) datastore.Cursor {
+		return datastore.Cursor{ID: p.ID}
+	}), nil
+}
+
+func (r productRepository) AddStock(ctx context.Context, id int64, delta int) error {
+	err := r.q.UpdateOne(ctx, datastore.UpdateParams{
+		Query:       `update PRODUCTS set STOCK = STOCK + ? where ID = ? and STOCK + ? >= 0`,
+		Vars:        []interface{}{delta, id, delta},
+		Conditional: true,
+	})
+	if datastore.IsConflict(err) {
+		if _, err := r.Get(ctx, id); err != nil {
+			return err
+		}
+		return gerrors.Newf(gerrors.OutOfStock, "product %d has less than %d in stock", id, -delta)
+	}
+	if err != nil {
+		return fmt.Errorf("add stock error: %w", err)
+	}
+	return nil
+}
+
+// reservationRepository runs its queries on q, which is either the DB or a transaction.
+type reservationRepository struct {
+	q datastore.Tx
+}
+
+func (r reservationRepository) Create(ctx context.Context, res *StockReservation) error {
+	id, err := r.q.InsertOne(ctx, datastore.InsertParams{
+		Query: `insert into STOCK_RESERVATIONS(ORDER_ID, PRODUCT_ID, QUANTITY) VALUES (?, ?, ?)`,
+		Vars:  []interface{}{res.OrderID, res.ProductID, res.Quantity},
+	})
+	if err != nil {
+		return fmt.Errorf("create stock reservation error: %w", err)
+	}
+
+	res.ID = id
+	return nil
+}
+
+func (r reservationRepository) ListByOrder(ctx context.Context, orderID int64) ([]StockReservation, error) {
+	var reservations []StockReservation
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		Query:   `select ID, ORDER_ID, PRODUCT_ID, QUANTITY, RELEASED_AT from STOCK_RESERVATIONS where ORDER_ID = ? order by ID`,
+		Filters: []interface{}{orderID},
+		Scan: func(row datastore.Scanner) error {
+			var (
+				res        StockReservation
+				releasedAt sql.NullTime
+			)
+			if err := row.Scan(&res.ID, &res.OrderID, &res.ProductID, &res.Quantity, &releasedAt); err != nil {
+				return err
+			}
+			res.ReleasedAt = releasedAt.Time
+			reservations = append(reservations, res)
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("list stock reservations error: %w", err)
+	}
+	return reservations, nil
+}
+
+func (r reservationRepository) Release(ctx context.Context, res *StockReservation) error {
+	now := time.Now().UTC()
+	if err := r.q.UpdateOne(ctx, datastore.UpdateParams{
+		Query:       `update STOCK_RESERVATIONS set RELEASED_AT = ? where ID = ? and RELEASED_AT is null`,
+		Vars:        []interface{}{now, res.ID},
+		Conditional: true,
+	}); err != nil {
+		return fmt.Errorf("release stock reservation error: %w", err)
+	}
+
+	res.ReleasedAt = now
+	return nil
+}
@@ -0,0 +1,188 @@
+// (C) Copyright 2022-2023 Hewlett Packard Enterprise Development LP
+
+// Package repository contains the typed access to the tables of the services,
+// so that handlers do not build SQL themselves.
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+)
+
+/*
+package name    : repository
+project         : qt-test-application
+*/
+
+type User struct {
+	ID       int64
+	UserName string
+	Account  string
+	// Amount caches the balance of the user: the ledger is the source of
+	// truth, Amount is updated in the transaction posting its entries.
+	Amount int
+	// Version is incremented by every update of the user, see UpdateBalance.
+	Version int64
+}
+
+type Order struct {
+	ID int64
+	// UserID and CreatedAt are zero for the orders created before they were recorded.
+	UserID  int64
+	Account string
+	// ProductName names the products of the order and Price is its total.
+	ProductName string
+	Price       int
+	Status      string
+	CreatedAt   time.Time
+	// Items is empty for the orders created before line items were recorded.
+	Items []OrderItem
+}
+
+// OrderItem is a line of an order: Quantity times the product at UnitPrice.
+type OrderItem struct {
+	ID          int64
+	OrderID     int64
+	ProductID   int64
+	ProductName string
+	UnitPrice   int
+	Quantity    int
+}
+
+type UserRepository interface {
+	// Create inserts u and sets its ID.
+	Create(ctx context.Context, u *User) error
+	// Get returns a user that is not deleted.
+	Get(ctx context.Context, id int64) (User, error)
+	// GetIncludingDeleted returns a user, deleted or not, e.g. to refund the
+	// orders a deleted user paid.
+	GetIncludingDeleted(ctx context.Context, id int64) (User, error)
+	// List returns the users that are not deleted.
+	List(ctx context.Context, f UserFilter, page datastore.Page) (datastore.PageResult[User], error)
+	// UpdateBalance adds delta, which may be negative, to the amount of u if u
+	// is still at u.Version, and fails with a gerrors.Conflict error otherwise.
+	// On success, u holds the new amount and version. The amount caches the
+	// sum of the ledger entries of the user: the caller posts them in the same
+	// transaction.
+	UpdateBalance(ctx context.Context, u *User, delta int) error
+	// Delete soft deletes the user: Get and List no longer return it, but the
+	// rows referring to it, such as its orders, are kept.
+	Delete(ctx context.Context, id int64) error
+}
+
+type OrderRepository interface {
+	// Create inserts o and its items and sets their IDs. The caller runs it in
+	// a transaction, so that no order is left without its items.
+	Create(ctx context.Context, o *Order) error
+	Get(ctx context.Context, id int64) (Order, error)
+	List(ctx context.Context, f OrderFilter, page datastore.Page) (datastore.PageResult[Order], error)
+	// UpdateStatus sets the status of o to status if o is still at o.Status,
+	// and fails with a gerrors.Conflict error otherwise.
+	UpdateStatus(ctx context.Context, o *Order, status string) error
+}
+
+// Store gives access to the repositories. The repositories of the Store passed
+// to the function of WithTx run in the same transaction.
+type Store interface {
+	Users() UserRepository
+	Orders() OrderRepository
+	Ledger() LedgerRepository
+	Sagas() SagaRepository
+	Products() ProductRepository
+	Reservations() ReservationRepository
+	Payments() PaymentRepository
+	WithTx(ctx context.Context, fn func(Store) error) error
+}
+
+// NewStore returns the Store backed by db.
+func NewStore(db datastore.DB) Store {
+	return dbStore{db: db}
+}
+
+type dbStore struct {
+	db datastore.DB
+}
+
+func (s dbStore) Users() UserRepository {
+	return userRepository{q: s.db}
+}
+
+func (s dbStore) Orders() OrderRepository {
+	return orderRepository{q: s.db}
+}
+
+func (s dbStore) Ledger() LedgerRepository {
+	return ledgerRepository{q: s.db}
+}
+
+func (s dbStore) Sagas() SagaRepository {
+	return sagaRepository{q: s.db}
+}
+
+func (s dbStore) Products() ProductRepository {
+	return productRepository{q: s.db}
+}
+
+func (s dbStore) Reservations() ReservationRepository {
+	return reservationRepository{q: s.db}
+}
+
+func (s dbStore) Payments() PaymentRepository {
+	return paymentRepository{q: s.db}
+}
+
+func (s dbStore) WithTx(ctx context.Context, fn func(Store) error) error {
+	return s.db.WithTx(ctx, func(tx datastore.Tx) error {
+		return fn(txStore{tx: tx})
+	})
+}
+
+type txStore struct {
+	tx datastore.Tx
+}
+
+func (s txStore) Users() UserRepository {
+	return userRepository{q: s.tx}
+}
+
+func (s txStore) Orders() OrderRepository {
+	return orderRepository{q: s.tx}
+}
+
+func (s txStore) Ledger() LedgerRepository {
+	return ledgerRepository{q: s.tx}
+}
+
+func (s txStore) Sagas() SagaRepository {
+	return sagaRepository{q: s.tx}
+}
+
+func (s txStore) Products() ProductRepository {
+	return productRepository{q: s.tx}
+}
+
+func (s txStore) Reservations() ReservationRepository {
+	return reservationRepository{q: s.tx}
+}
+
+func (s txStore) Payments() PaymentRepository {
+	return paymentRepository{q: s.tx}
+}
+
+// WithTx joins the transaction the store already runs in.
+func (s txStore) WithTx(ctx context.Context, fn func(Store) error) error {
+	return fn(s)
+}
+
+// notFound maps a missing row to gerrors.NotFound.
+func notFound(err error, format string, insert ...interface{}) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return gerrors.Newf(gerrors.NotFound, format, insert...)
+	}
+	return err
+}
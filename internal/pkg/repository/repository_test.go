@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+)
+
+// TestGetNotFound checks that getting a missing row fails with a
+// gerrors.NotFound error rather than the sql.ErrNoRows of the driver.
+func TestGetNotFound(t *testing.T) {
+	for _, driver := range []string{datastore.DriverMemory, datastore.DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			store := newTestStore(t, driver)
+			ctx := context.Background()
+
+			deleted := User{UserName: "a", Account: "a"}
+			if err := store.Users().Create(ctx, &deleted); err != nil {
+				t.Fatalf("create user: %v", err)
+			}
+			if err := store.Users().Delete(ctx, deleted.ID); err != nil {
+				t.Fatalf("delete user: %v", err)
+			}
+
+			if u, err := store.Users().GetIncludingDeleted(ctx, deleted.ID); err != nil || u.ID != deleted.ID {
+				t.Errorf("get deleted user including deleted: got %+v, %v, want user %d", u, err, deleted.ID)
+			}
+
+			for _, tc := range []struct {
+				name string
+				get  func() error
+			}{
+				{"missing user", func() error { _, err := store.Users().Get(ctx, 42); return err }},
+				{"deleted user", func() error { _, err := store.Users().Get(ctx, deleted.ID); return err }},
+				{"missing user including deleted", func() error { _, err := store.Users().GetIncludingDeleted(ctx, 42); return err }},
+				{"missing order", func() error { _, err := store.Orders().Get(ctx, 42); return err }},
+			} {
+				err := tc.get()
+				var gerr gerrors.Gerror
+				if !errors.As(err, &gerr) || !gerr.EqualTag(gerrors.NotFound) {
+					t.Errorf("get %s: got %v, want a not found error", tc.name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+)
+
+// Saga statuses. A saga is RUNNING while its steps run and COMPENSATING while
+// the steps it ran are undone. COMPLETED and COMPENSATED are final.
+const (
+	SagaRunning      = "RUNNING"
+	SagaCompensating = "COMPENSATING"
+	SagaCompleted    = "COMPLETED"
+	SagaCompensated  = "COMPENSATED"
+)
+
+// Saga is the persisted state of the placement of an order.
+type Saga struct {
+	ID      int64
+	OrderID int64
+	// Step is the number of steps run while RUNNING, and the number of steps
+	// left to compensate while COMPENSATING.
+	Step   int
+	Status string
+	// Error is the failure of the step that made the saga compensate.
+	Error string
+	// Version is incremented by every save of the saga, see Save.
+	Version int64
+	// LeaseOwner is the instance running the saga until LeaseUntil. Once the
+	// lease expired, e.g. after a crash, another instance may take it over.
+	LeaseOwner string
+	LeaseUntil time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+type SagaRepository interface {
+	// Create inserts s and sets its ID.
+	Create(ctx context.Context, s *Saga) error
+	// Save stores s, its lease included, if it is still at s.Version, and
+	// fails with a gerrors.Conflict error otherwise. On success, s holds the
+	// new version.
+	Save(ctx context.Context, s *Saga) error
+	// ListExpired returns at most limit sagas that are not final and whose
+	// lease expired before now, oldest first.
+	ListExpired(ctx context.Context, now time.Time, limit int) ([]Saga, error)
+}
+
+const sagaColumns = `ID, ORDER_ID, STEP, STATUS, ERROR, VERSION, LEASE_OWNER, LEASE_UNTIL, CREATED_AT, UPDATED_AT`
+
+// sagaRepository runs its queries on q, which is either the DB or a transaction.
+type sagaRepository struct {
+	q datastore.Tx
+}
+
+func (r sagaRepository) Create(ctx context.Context, s *Saga) error {
+	now := time.Now().UTC()
+	s.CreatedAt, s.UpdatedAt = now, now
+
+	id, err := r.q.InsertOne(ctx, datastore.InsertParams{
+		Query: `insert into SAGAS(ORDER_ID, STEP, STATUS, ERROR, VERSION, LEASE_OWNER, LEASE_UNTIL, CREATED_AT, UPDATED_AT) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		Vars:  []interface{}{s.OrderID, s.Step, s.Status, nullString(s.Error), s.Version, nullString(s.LeaseOwner), nullTime(s.LeaseUntil), s.CreatedAt, s.UpdatedAt},
+	})
+	if err != nil {
+		return fmt.Errorf("create saga error: %w", err)
+	}
+
+	s.ID = id
+	return nil
+}
+
+func (r sagaRepository) Save(ctx context.Context, s *Saga) error {
+	now := time.Now().UTC()
+	if err := r.q.UpdateOne(ctx, datastore.UpdateParams{
+		Query:       `update SAGAS set STEP = ?, STATUS = ?, ERROR = ?, VERSION = VERSION + 1, LEASE_OWNER = ?, LEASE_UNTIL = ?, UPDATED_AT = ? where ID = ? and VERSION = ?`,
+		Vars:        []interface{}{s.Step, s.Status, nullString(s.Error), nullString(s.LeaseOwner), nullTime(s.LeaseUntil), now, s.ID, s.Version},
+		Conditional: true,
+	}); err != nil {
+		return fmt.Errorf("save saga error: %w", err)
+	}
+
+	s.Version++
+	s.UpdatedAt = now
+	return nil
+}
+
+func (r sagaRepository) ListExpired(ctx context.Context, now time.Time, limit int) ([]Saga, error) {
+	var sagas []Saga
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		// the sagas saved before they had a lease have none.
+		Query: `select ` + sagaColumns + ` from SAGAS
+			where STATUS in (?, ?) and (LEASE_UNTIL is null or LEASE_UNTIL < ?) order by ID limit ?`,
+		Filters: []interface{}{SagaRunning, SagaCompensating, now.UTC(), limit},
+		Scan: func(row datastore.Scanner) error {
+			var (
+				s          Saga
+				sagaErr    sql.NullString
+				leaseOwner sql.NullString
+				leaseUntil sql.NullTime
+			)
+			if err := row.Scan(&s.ID, &s.OrderID, &s.Step, &s.Status, &sagaErr, &s.Version, &leaseOwner, &leaseUntil, &s.CreatedAt, &s.UpdatedAt); err != nil {
+				return err
+			}
+			s.Error, s.LeaseOwner, s.LeaseUntil = sagaErr.String, leaseOwner.String, leaseUntil.Time
+			sagas = append(sagas, s)
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("list expired sagas error: %w", err)
+	}
+
+	return sagas, nil
+}
+
+// nullTime stores a zero time as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// nullString stores an empty string as NULL.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+)
+
+// TestSagaLease checks that a saga is listed for resumption only once its
+// lease expired, and taken over once.
+func TestSagaLease(t *testing.T) {
+	for _, driver := range []string{datastore.DriverMemory, datastore.DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			store := newTestStore(t, driver)
+			ctx := context.Background()
+
+			now := time.Now()
+			s := Saga{OrderID: 1, Step: 1, Status: SagaRunning, LeaseOwner: "a", LeaseUntil: now.Add(time.Minute)}
+			if err := store.Sagas().Create(ctx, &s); err != nil {
+				t.Fatalf("create saga: %v", err)
+			}
+			done := Saga{OrderID: 2, Step: 3, Status: SagaCompleted, LeaseOwner: "a", LeaseUntil: now.Add(-time.Minute)}
+			if err := store.Sagas().Create(ctx, &done); err != nil {
+				t.Fatalf("create saga: %v", err)
+			}
+
+			if expired, err := store.Sagas().ListExpired(ctx, now, 10); err != nil || len(expired) != 0 {
+				t.Fatalf("expired sagas while leased = %+v, %v, want none", expired, err)
+			}
+
+			expired, err := store.Sagas().ListExpired(ctx, now.Add(2*time.Minute), 10)
+			if err != nil {
+				t.Fatalf("list expired sagas: %v", err)
+			}
+			if len(expired) != 1 || expired[0].ID != s.ID || expired[0].LeaseOwner != "a" {
+				t.Fatalf("expired sagas = %+v, want saga %d leased by a", expired, s.ID)
+			}
+
+			takeover := expired[0]
+			takeover.LeaseOwner, takeover.LeaseUntil = "b", now.Add(3*time.Minute)
+			if err := store.Sagas().Save(ctx, &takeover); err != nil {
+				t.Fatalf("take saga over: %v", err)
+			}
+			if err := store.Sagas().Save(ctx, &expired[0]); !datastore.IsConflict(err) {
+				t.Fatalf("take saga over again: got %v, want a conflict", err)
+			}
+			if expired, err = store.Sagas().ListExpired(ctx, now.Add(2*time.Minute), 10); err != nil || len(expired) != 0 {
+				t.Fatalf("expired sagas after takeover = %+v, %v, want none", expired, err)
+			}
+		})
+	}
+}
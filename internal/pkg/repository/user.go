@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+)
+
+// UserSort orders a list of users. A leading - sorts in descending order.
+type UserSort string
+
+const (
+	SortByID           UserSort = "id"
+	SortByIDDesc       UserSort = "-id"
+	SortByUserName     UserSort = "user_name"
+	SortByUserNameDesc UserSort = "-user_name"
+)
+
+// ParseUserSort validates the sort of a list request. An empty sort is SortByID.
+func ParseUserSort(s string) (UserSort, error) {
+	switch sort := UserSort(s); sort {
+	case "":
+		return SortByID, nil
+	case SortByID, SortByIDDesc, SortByUserName, SortByUserNameDesc:
+		return sort, nil
+	default:
+		return "", gerrors.Newf(gerrors.BadRequest, "invalid sort %q: must be one of id, -id, user_name, -user_name", s)
+	}
+}
+
+func (s UserSort) desc() bool {
+	return strings.HasPrefix(string(s), "-")
+}
+
+// UserFilter selects the users of a list. Its zero value selects all users by ID.
+type UserFilter struct {
+	Account        string
+	UserNamePrefix string
+	Sort           UserSort
+}
+
+// userRepository runs its queries on q, which is either the DB or a transaction.
+type userRepository struct {
+	q datastore.Tx
+}
+
+func (r userRepository) Create(ctx context.Context, u *User) error {
+	id, err := r.q.InsertOne(ctx, datastore.InsertParams{
+		Query: `insert into USERS(USER_NAME, ACCOUNT) VALUES (?, ?)`,
+		Vars:  []interface{}{u.UserName, u.Account},
+	})
+	if err != nil {
+		return fmt.Errorf("create user error: %w", err)
+	}
+
+	u.ID = id
+	return nil
+}
+
+func (r userRepository) Get(ctx context.Context, id int64) (User, error) {
+	return r.get(ctx, id, ` and DELETED_AT is null`)
+}
+
+func (r userRepository) GetIncludingDeleted(ctx context.Context, id int64) (User, error) {
+	return r.get(ctx, id, ``)
+}
+
+// get returns the user with the given ID matching the extra conditions of where.
+func (r userRepository) get(ctx context.Context, id int64, where string) (User, error) {
+	var u User
+	if err := r.q.SelectOne(ctx, datastore.SelectParams{
+		Query:   `select ID, USER_NAME, ACCOUNT, AMOUNT, VERSION from USERS where ID = ?` + where,
+		Filters: []interface{}{id},
+		Result:  []interface{}{&u.ID, &u.UserName, &u.Account, &u.Amount, &u.Version},
+	}); err != nil {
+		return User{}, notFound(err, "user %d not found", id)
+	}
+
+	return u, nil
+}
+
+func (r userRepository) List(ctx context.Context, f UserFilter, page datastore.Page) (datastore.PageResult[User], error) {
+	where := []string{"DELETED_AT is null"}
+	var filters []interface{}
+	if f.Account != "" {
+		where = append(where, "ACCOUNT = ?")
+		filters = append(filters, f.Account)
+	}
+	if f.UserNamePrefix != "" {
+		where = append(where, "USER_NAME like ? escape '!'")
+		filters = append(filters, likePrefix(f.UserNamePrefix))
+	}
+
+	// keyset pagination: continue after the last row of the previous page in
+	// the sort order, with ID breaking ties.
+	op, dir := ">", "asc"
+	if f.Sort.desc() {
+		op, dir = "<", "desc"
+	}
+	orderBy := "ID " + dir
+	byName := f.Sort == SortByUserName || f.Sort == SortByUserNameDesc
+	if byName {
+		orderBy = "USER_NAME " + dir + ", ID " + dir
+	}
+	if after := page.After; after != nil {
+		if byName {
+			where = append(where, "(USER_NAME "+op+" ? or (USER_NAME = ? and ID "+op+" ?))")
+			filters = append(filters, after.Key, after.Key, after.ID)
+		} else {
+			where = append(where, "ID "+op+" ?")
+			filters = append(filters, after.ID)
+		}
+	}
+
+	var users []User
+	if err := r.q.SelectMany(ctx, datastore.SelectManyParams{
+		Query: `select ID, USER_NAME, ACCOUNT, AMOUNT, VERSION from USERS where ` + strings.Join(where, " and ") +
+			` order by ` + orderBy + ` limit ?`,
+		Filters: append(filters, page.Fetch()),
+		Scan: func(row datastore.Scanner) error {
+			var u User
+			if err := row.Scan(&u.ID, &u.UserName, &u.Account, &u.Amount, &u.Version); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		},
+	}); err != nil {
+		return datastore.PageResult[User]{}, fmt.Errorf("list users error: %w", err)
+	}
+
+	return datastore.Paginate(page, users, func(u User) datastore.Cursor {
+		if byName {
+			return datastore.Cursor{ID: u.ID, Key: u.UserName}
+		}
+		return datastore.Cursor{ID: u.ID}
+	}), nil
+}
+
+func (r userRepository) UpdateBalance(ctx context.Context, u *User, delta int) error {
+	if err := r.q.UpdateOne(ctx, datastore.UpdateParams{
+		Query:       `update USERS set AMOUNT = AMOUNT + ?, VERSION = VERSION + 1 where ID = ? and VERSION = ?`,
+		Vars:        []interface{}{delta, u.ID, u.Version},
+		Conditional: true,
+	}); err != nil {
+		return fmt.Errorf("update user balance error: %w", err)
+	}
+
+	u.Amount += delta
+	u.Version++
+	return nil
+}
+
+func (r userRepository) Delete(ctx context.Context, id int64) error {
+	if err := r.q.UpdateOne(ctx, datastore.UpdateParams{
+		Query:       `update USERS set DELETED_AT = ?, VERSION = VERSION + 1 where ID = ? and DELETED_AT is null`,
+		Vars:        []interface{}{time.Now().UTC(), id},
+		Conditional: true,
+	}); err != nil {
+		if datastore.IsConflict(err) {
+			return gerrors.Newf(gerrors.NotFound, "user %d not found", id)
+		}
+		return fmt.Errorf("delete user error: %w", err)
+	}
+
+	return nil
+}
+
+// likePrefix returns the LIKE pattern, with '!' as escape character, matching
+// the strings starting with prefix.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+}
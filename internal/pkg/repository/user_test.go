@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+)
+
+// TestListUsersPages walks the pages of the users and checks that every user
+// is listed once, and that the last page has no next cursor, also when it is
+// full.
+func TestListUsersPages(t *testing.T) {
+	for _, driver := range []string{datastore.DriverMemory, datastore.DriverSQLite} {
+		for _, count := range []int{0, 1, 4, 5} {
+			t.Run(fmt.Sprintf("%s/%d users", driver, count), func(t *testing.T) {
+				store := newTestStore(t, driver)
+				ctx := context.Background()
+
+				var want []int64
+				for i := 0; i < count; i++ {
+					u := User{UserName: fmt.Sprintf("u%d", i), Account: "a"}
+					if err := store.Users().Create(ctx, &u); err != nil {
+						t.Fatalf("create user: %v", err)
+					}
+					want = append(want, u.ID)
+				}
+
+				for _, sort := range []UserSort{SortByID, SortByUserNameDesc} {
+					var (
+						got   []int64
+						pages int
+					)
+					page := datastore.Page{Limit: 2}
+					for {
+						res, err := store.Users().List(ctx, UserFilter{Sort: sort}, page)
+						if err != nil {
+							t.Fatalf("list users: %v", err)
+						}
+						pages++
+						for _, u := range res.Items {
+							got = append(got, u.ID)
+						}
+						if res.NextCursor == "" {
+							break
+						}
+						if len(res.Items) != page.Limit {
+							t.Fatalf("page %d of %s has %d users and a next cursor", pages, sort, len(res.Items))
+						}
+						if page, err = datastore.NewPage(page.Limit, res.NextCursor); err != nil {
+							t.Fatalf("next page: %v", err)
+						}
+					}
+
+					wantSorted := append([]int64(nil), want...)
+					if sort == SortByUserNameDesc {
+						for i, j := 0, len(wantSorted)-1; i < j; i, j = i+1, j-1 {
+							wantSorted[i], wantSorted[j] = wantSorted[j], wantSorted[i]
+						}
+					}
+					if !reflect.DeepEqual(got, wantSorted) {
+						t.Errorf("users by %s = %v, want %v", sort, got, wantSorted)
+					}
+					// a full last page is not followed by an empty one.
+					wantPages := (count + 1) / 2
+					if wantPages == 0 {
+						wantPages = 1
+					}
+					if pages != wantPages {
+						t.Errorf("pages by %s = %d, want %d", sort, pages, wantPages)
+					}
+				}
+			})
+		}
+	}
+}
@@ -10,11 +10,15 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/health"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/repository"
 	"github.com/naga2HPE/qt-test-application/internal/pkg/utils"
 	"github.com/rs/cors"
 	logger "github.com/sirupsen/logrus"
@@ -31,31 +35,25 @@ project         : qt-test-application
 
 const serviceName = "user-service"
 
+// maxUpdateAttempts bounds the retries of an update whose user was updated concurrently.
+const maxUpdateAttempts = 3
+
 var (
-	db     datastore.DB
+	store  repository.Store
 	srv    *http.Server
 	tracer trace.Tracer
+	ready  health.Readiness
 )
 
 func SetupServer(configurations *config.ServiceConfigurations) {
 	tracer = otel.Tracer(serviceName)
-	router := mux.NewRouter()
-	router.HandleFunc("/users", createUser).Methods(http.MethodPost, http.MethodOptions)
-	router.HandleFunc("/users/{userID}", getUser).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/users/{userID}", updateUser).Methods(http.MethodPut, http.MethodOptions)
-	router.Use(utils.LoggingMW)
-	router.Use(otelmux.Middleware(serviceName))
-	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{http.MethodGet, http.MethodPut, http.MethodPost},
-	})
 
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt)
 
 	srv = &http.Server{
 		Addr:    configurations.UserURL,
-		Handler: c.Handler(router),
+		Handler: newHandler(),
 	}
 
 	log.Printf("User service running at: %s", configurations.UserURL)
@@ -71,11 +69,41 @@ func SetupServer(configurations *config.ServiceConfigurations) {
 	}
 }
 
+// newHandler routes the requests of the user service.
+func newHandler() http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/users", createUser).Methods(http.MethodPost, http.MethodOptions)
+	router.HandleFunc("/users", listUsers).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/users/{userID}", getUser).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/users/{userID}", updateUser).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/users/{userID}", deleteUser).Methods(http.MethodDelete, http.MethodOptions)
+	router.HandleFunc("/users/{userID}/debit", debitUser).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/users/{userID}/refund", refundUser).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/users/{userID}/transfer", transferUser).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc("/users/{userID}/transactions", getTransactions).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/users/{userID}/balance", getBalance).Methods(http.MethodGet, http.MethodOptions)
+	ready.Register(router)
+	router.Use(utils.LoggingMW)
+	router.Use(ready.Middleware)
+	router.Use(otelmux.Middleware(serviceName))
+	c := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete},
+	})
+	return c.Handler(router)
+}
+
+// InitDB connects to the database in the background. Until it is connected,
+// the service reports not ready instead of exiting.
 func InitDB(cnf *config.ServiceConfigurations) {
-	var err error
-	if db, err = datastore.New(cnf); err != nil {
-		log.Fatalf("failed to initialize db: %v", err)
-	}
+	go func() {
+		conn, err := datastore.New(cnf)
+		if err != nil {
+			log.Fatalf("failed to initialize db: %v", err)
+		}
+		store = repository.NewStore(conn)
+		ready.SetReady()
+	}()
 }
 
 type user struct {
@@ -85,8 +113,45 @@ type user struct {
 	Amount   int
 }
 
+func newUser(u repository.User) user {
+	return user{ID: u.ID, UserName: u.UserName, Account: u.Account, Amount: u.Amount}
+}
+
+// parseUserID validates the userID path parameter.
+func parseUserID(userID string) (int64, error) {
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, gerrors.Newf(gerrors.BadRequest, "invalid user id %q: must be a positive number", userID)
+	}
+	return id, nil
+}
+
 type paymentData struct {
 	Amount int `json:"amount" validate:"required"`
+	// PaymentID is the payment made by the payment service, 0 if none.
+	PaymentID int64 `json:"payment_id,omitempty"`
+}
+
+type orderPaymentData struct {
+	Amount  int   `json:"amount" validate:"required,gt=0"`
+	OrderID int64 `json:"order_id" validate:"required"`
+	// PaymentID is the payment made by the payment service, 0 if none.
+	PaymentID int64 `json:"payment_id,omitempty"`
+}
+
+// balanceChange answers the balance endpoints called by the payment service.
+type balanceChange struct {
+	// Applied is false if the change had already been made and was skipped.
+	Applied bool `json:"applied"`
+}
+
+type transferData struct {
+	ToUserID int64 `json:"to_user_id" validate:"required,gt=0"`
+	Amount   int   `json:"amount" validate:"required,gt=0"`
+	// DebitPaymentID and CreditPaymentID are the payments made by the payment
+	// service for both legs, 0 if none.
+	DebitPaymentID  int64 `json:"debit_payment_id,omitempty"`
+	CreditPaymentID int64 `json:"credit_payment_id,omitempty"`
 }
 
 func createUser(w http.ResponseWriter, r *http.Request) {
@@ -95,60 +160,381 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, span := tracer.Start(r.Context(), "create user")
+	ctx, span := tracer.Start(r.Context(), "create user")
 	defer span.End()
 
-	id := time.Now().UnixMilli()
-	// id, err := db.InsertOne(ctx, datastore.InsertParams{
-	// 	Query: `INSERT INTO USERS(USER_NAME, ACCOUNT) VALUES (?, ?)`,
-	// 	Vars:  []interface{}{u.UserName, u.Account},
-	// })
-	// if err != nil {
-	// 	utils.WriteErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("create user error: %w", err))
-	// 	return
-	// }
-	logger.Infof("user ID :%s", id)
-	u.ID = id
-	utils.WriteResponse(w, http.StatusCreated, u)
+	stored := repository.User{UserName: u.UserName, Account: u.Account}
+	if err := store.Users().Create(ctx, &stored); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	logger.Infof("user ID :%d", stored.ID)
+	span.SetAttributes(attribute.Int64("userID", stored.ID))
+
+	utils.WriteResponse(w, http.StatusCreated, newUser(stored))
 }
 
 func getUser(w http.ResponseWriter, r *http.Request) {
 	userID := mux.Vars(r)["userID"]
-	// var u user
 
-	_, span := tracer.Start(r.Context(), "get user")
+	ctx, span := tracer.Start(r.Context(), "get user")
 	defer span.End()
 	span.SetAttributes(attribute.String("userID", userID))
 
-	// if err := db.SelectOne(ctx, datastore.SelectParams{
-	// 	Query:   `select ID, USER_NAME, ACCOUNT, AMOUNT from USERS where ID = ?`,
-	// 	Filters: []interface{}{userID},
-	// 	Result:  []interface{}{&u.ID, &u.UserName, &u.Account, &u.Amount},
-	// }); err != nil {
-	// 	utils.WriteErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("get user error: %w", err))
-	// 	return
-	// }
+	id, err := parseUserID(userID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	stored, err := store.Users().Get(ctx, id)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
 
-	utils.WriteResponse(w, http.StatusOK, user{ID: 1234, UserName: "JAD", Account: "jad", Amount: 1000})
+	utils.WriteResponse(w, http.StatusOK, newUser(stored))
 }
 
-func updateUser(w http.ResponseWriter, r *http.Request) {
+// listUsers lists the users. The query parameters account and user_name
+// filter on the account and on a prefix of the user name, sort orders the
+// list and limit and cursor select the page.
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	page, err := datastore.ReadPage(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	sort, err := repository.ParseUserSort(query.Get("sort"))
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+	filter := repository.UserFilter{
+		Account:        query.Get("account"),
+		UserNamePrefix: query.Get("user_name"),
+		Sort:           sort,
+	}
+
+	ctx, span := tracer.Start(r.Context(), "list users")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("account", filter.Account),
+		attribute.String("user_name", filter.UserNamePrefix),
+		attribute.String("sort", string(filter.Sort)),
+	)
+
+	users, err := store.Users().List(ctx, filter, page)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	response := datastore.PageResult[user]{Items: make([]user, 0, len(users.Items)), NextCursor: users.NextCursor}
+	for _, u := range users.Items {
+		response.Items = append(response.Items, newUser(u))
+	}
+	utils.WriteResponse(w, http.StatusOK, response)
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request) {
 	userID := mux.Vars(r)["userID"]
+
+	ctx, span := tracer.Start(r.Context(), "delete user")
+	defer span.End()
+	span.SetAttributes(attribute.String("userID", userID))
+
+	id, err := parseUserID(userID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	if err := store.Users().Delete(ctx, id); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func updateUser(w http.ResponseWriter, r *http.Request) {
 	var data paymentData
 	if err := utils.ReadBody(w, r, &data); err != nil {
 		return
 	}
 
-	_, span := tracer.Start(r.Context(), "update user amount")
+	changeBalance(w, r, "update user amount", repository.LedgerEntry{Reason: repository.ReasonPayment, PaymentID: data.PaymentID}, repository.AccountPayments, data.Amount, nil)
+}
+
+// debitUser charges the price of an order to the user. It is called by the
+// payment service. An order is charged once: debiting it again does nothing.
+func debitUser(w http.ResponseWriter, r *http.Request) {
+	var data orderPaymentData
+	if err := utils.ReadBody(w, r, &data); err != nil {
+		return
+	}
+
+	changeBalance(w, r, "debit user amount", repository.LedgerEntry{Reason: repository.ReasonOrder, OrderID: data.OrderID, PaymentID: data.PaymentID}, repository.AccountSales, -data.Amount,
+		func(ctx context.Context, ledger repository.LedgerRepository, u repository.User) (bool, error) {
+			return ledger.HasOrderEntry(ctx, u.ID, data.OrderID, repository.ReasonOrder)
+		})
+}
+
+// refundUser gives the price of an order back to the user. It is called by
+// the payment service. Only a charged order is refunded, and only once:
+// refunding it otherwise does nothing. A deleted user is refunded as well.
+func refundUser(w http.ResponseWriter, r *http.Request) {
+	var data orderPaymentData
+	if err := utils.ReadBody(w, r, &data); err != nil {
+		return
+	}
+
+	changeBalance(w, r, "refund user amount", repository.LedgerEntry{Reason: repository.ReasonRefund, OrderID: data.OrderID, PaymentID: data.PaymentID}, repository.AccountSales, data.Amount,
+		func(ctx context.Context, ledger repository.LedgerRepository, u repository.User) (bool, error) {
+			charged, err := ledger.HasOrderEntry(ctx, u.ID, data.OrderID, repository.ReasonOrder)
+			if err != nil || !charged {
+				return true, err
+			}
+			return ledger.HasOrderEntry(ctx, u.ID, data.OrderID, repository.ReasonRefund)
+		})
+}
+
+// changeBalance adds delta to the amount of the user of the request and posts
+// it to the ledger against the system account counter, in one transaction. A
+// debit beyond the amount of the user is rejected. If done is not nil and
+// reports true, the change was already made and the user is left as is. The
+// response tells which, so that the payment service only moves the money at
+// its gateway once.
+func changeBalance(w http.ResponseWriter, r *http.Request, spanName string, base repository.LedgerEntry, counter string, delta int,
+	done func(ctx context.Context, ledger repository.LedgerRepository, u repository.User) (bool, error)) {
+	userID := mux.Vars(r)["userID"]
+	id, err := parseUserID(userID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	ctx, span := tracer.Start(r.Context(), spanName)
+	defer span.End()
+	span.SetAttributes(attribute.String("userID", userID), attribute.Int("amount", delta))
+
+	var change balanceChange
+	if err := datastore.RetryOnConflict(ctx, maxUpdateAttempts, func() error {
+		change.Applied = false
+		return store.WithTx(ctx, func(tx repository.Store) error {
+			get := tx.Users().Get
+			// the orders a user paid are still refunded once the user is deleted.
+			if base.Reason == repository.ReasonRefund {
+				get = tx.Users().GetIncludingDeleted
+			}
+			u, err := get(ctx, id)
+			if err != nil {
+				return err
+			}
+			if done != nil {
+				skip, err := done(ctx, tx.Ledger(), u)
+				if err != nil {
+					return err
+				}
+				if skip {
+					span.AddEvent("balance already changed")
+					return nil
+				}
+			}
+			if delta < 0 && u.Amount+delta < 0 {
+				return gerrors.Newf(gerrors.InsufficientBalance, "insufficient balance. add %d more amount to account", -(u.Amount + delta))
+			}
+			if err := tx.Users().UpdateBalance(ctx, &u, delta); err != nil {
+				return err
+			}
+			change.Applied = true
+			return tx.Ledger().Post(ctx, repository.DoubleEntry(base, u, counter, delta)...)
+		})
+	}); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	utils.WriteResponse(w, http.StatusOK, change)
+}
+
+// transferUser moves an amount from the user of the request to another user,
+// in one transaction. It is called by the payment service.
+func transferUser(w http.ResponseWriter, r *http.Request) {
+	var data transferData
+	if err := utils.ReadBody(w, r, &data); err != nil {
+		return
+	}
+
+	userID := mux.Vars(r)["userID"]
+	id, err := parseUserID(userID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	ctx, span := tracer.Start(r.Context(), "transfer user amount")
+	defer span.End()
+	span.SetAttributes(attribute.String("userID", userID), attribute.Int64("toUserID", data.ToUserID), attribute.Int("amount", data.Amount))
+
+	if id == data.ToUserID {
+		utils.WriteError(w, gerrors.Newf(gerrors.BadRequest, "user %d cannot transfer to itself", id))
+		return
+	}
+
+	if err := datastore.RetryOnConflict(ctx, maxUpdateAttempts, func() error {
+		return store.WithTx(ctx, func(tx repository.Store) error {
+			from, err := tx.Users().Get(ctx, id)
+			if err != nil {
+				return err
+			}
+			to, err := tx.Users().Get(ctx, data.ToUserID)
+			if err != nil {
+				return err
+			}
+			if from.Amount < data.Amount {
+				return gerrors.Newf(gerrors.InsufficientBalance, "insufficient balance. add %d more amount to account", data.Amount-from.Amount)
+			}
+
+			// the users are updated in the order of their IDs, so that
+			// opposite transfers do not lock each other.
+			updates := []struct {
+				u     *repository.User
+				delta int
+			}{{&from, -data.Amount}, {&to, data.Amount}}
+			if to.ID < from.ID {
+				updates[0], updates[1] = updates[1], updates[0]
+			}
+			for _, update := range updates {
+				if err := tx.Users().UpdateBalance(ctx, update.u, update.delta); err != nil {
+					return err
+				}
+			}
+
+			base := repository.LedgerEntry{Reason: repository.ReasonTransfer}
+			debit, credit := base, base
+			debit.UserID, debit.Account, debit.Amount, debit.PaymentID = from.ID, from.Account, -data.Amount, data.DebitPaymentID
+			credit.UserID, credit.Account, credit.Amount, credit.PaymentID = to.ID, to.Account, data.Amount, data.CreditPaymentID
+			return tx.Ledger().Post(ctx, debit, credit)
+		})
+	}); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	utils.WriteResponse(w, http.StatusOK, balanceChange{Applied: true})
+}
+
+type transaction struct {
+	ID        int64     `json:"id"`
+	Account   string    `json:"account"`
+	Amount    int       `json:"amount"`
+	Reason    string    `json:"reason"`
+	OrderID   int64     `json:"order_id,omitempty"`
+	PaymentID int64     `json:"payment_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// getTransactions lists the ledger entries of a user, deleted or not, oldest
+// first, only those of the payment given by the query parameter payment_id if
+// any. The query parameters limit and cursor select the page.
+func getTransactions(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	id, err := parseUserID(userID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	page, err := datastore.ReadPage(r)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	f := repository.LedgerFilter{UserID: id}
+	if paymentID := r.URL.Query().Get("payment_id"); paymentID != "" {
+		if f.PaymentID, err = strconv.ParseInt(paymentID, 10, 64); err != nil || f.PaymentID <= 0 {
+			utils.WriteError(w, gerrors.Newf(gerrors.BadRequest, "invalid payment id %q: must be a positive number", paymentID))
+			return
+		}
+	}
+
+	ctx, span := tracer.Start(r.Context(), "get user transactions")
+	defer span.End()
+	span.SetAttributes(attribute.String("userID", userID))
+
+	// the ledger of a deleted user is kept: the payment service reconciles
+	// its payments with it.
+	if _, err := store.Users().GetIncludingDeleted(ctx, id); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	entries, err := store.Ledger().List(ctx, f, page)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	response := datastore.PageResult[transaction]{Items: make([]transaction, 0, len(entries.Items)), NextCursor: entries.NextCursor}
+	for _, e := range entries.Items {
+		response.Items = append(response.Items, transaction{
+			ID:        e.ID,
+			Account:   e.Account,
+			Amount:    e.Amount,
+			Reason:    e.Reason,
+			OrderID:   e.OrderID,
+			PaymentID: e.PaymentID,
+			CreatedAt: e.CreatedAt,
+		})
+	}
+	utils.WriteResponse(w, http.StatusOK, response)
+}
+
+// userBalance is the amount of a user next to the sum of its ledger entries,
+// which the amount caches.
+type userBalance struct {
+	Amount       int  `json:"amount"`
+	LedgerAmount int  `json:"ledger_amount"`
+	Reconciled   bool `json:"reconciled"`
+}
+
+// getBalance checks the amount of a user against its ledger entries.
+func getBalance(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	id, err := parseUserID(userID)
+	if err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	ctx, span := tracer.Start(r.Context(), "check user balance")
 	defer span.End()
 	span.SetAttributes(attribute.String("userID", userID))
-	// if err := db.UpdateOne(ctx, datastore.UpdateParams{
-	// 	Query: `update USERS set AMOUNT = AMOUNT + ? where ID = ?`,
-	// 	Vars:  []interface{}{data.Amount, userID},
-	// }); err != nil {
-	// 	utils.WriteErrorResponse(w, http.StatusInternalServerError, fmt.Errorf("get user error: %w", err))
-	// 	return
-	// }
-
-	w.WriteHeader(http.StatusOK)
+
+	// both are read in one transaction, so that no change falls in between.
+	var balance userBalance
+	if err := store.WithTx(ctx, func(tx repository.Store) error {
+		u, err := tx.Users().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		balance.Amount = u.Amount
+		balance.LedgerAmount, err = tx.Ledger().Balance(ctx, id)
+		return err
+	}); err != nil {
+		utils.WriteError(w, err)
+		return
+	}
+
+	balance.Reconciled = balance.Amount == balance.LedgerAmount
+	span.SetAttributes(attribute.Bool("reconciled", balance.Reconciled))
+	if !balance.Reconciled {
+		log.Printf("user %d amount %d differs from its ledger amount %d", id, balance.Amount, balance.LedgerAmount)
+	}
+	utils.WriteResponse(w, http.StatusOK, balance)
 }
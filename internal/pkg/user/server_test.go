@@ -0,0 +1,181 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/datastore"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/repository"
+	"go.opentelemetry.io/otel"
+)
+
+// newTestServer serves the user service on an empty database.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	cnf, err := config.GetServiceConfigurations()
+	if err != nil {
+		t.Fatalf("get configurations: %v", err)
+	}
+	cnf.DBDriver = datastore.DriverSQLite
+	cnf.SqlitePath = t.TempDir() + "/test.db"
+
+	db, err := datastore.New(cnf)
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	store = repository.NewStore(db)
+	tracer = otel.Tracer(serviceName)
+	ready.SetReady()
+
+	srv := httptest.NewServer(newHandler())
+	t.Cleanup(func() {
+		srv.Close()
+		db.Close()
+	})
+	return srv
+}
+
+// send sends body as JSON to path and returns the status and body of the response.
+func send(t *testing.T, srv *httptest.Server, method, path string, body interface{}) (int, []byte) {
+	t.Helper()
+	var payload io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal %s %s: %v", method, path, err)
+		}
+		payload = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, payload)
+	if err != nil {
+		t.Fatalf("new request %s %s: %v", method, path, err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read %s %s: %v", method, path, err)
+	}
+	return resp.StatusCode, respBody
+}
+
+// TestBalanceMatchesLedger changes the balances through every endpoint and
+// checks that the amounts of the users still match their ledger entries.
+func TestBalanceMatchesLedger(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, name := range []string{"a", "b"} {
+		if status, body := send(t, srv, http.MethodPost, "/users", user{UserName: name, Account: name}); status != http.StatusCreated {
+			t.Fatalf("create user %s: got %d %s", name, status, body)
+		}
+	}
+
+	for _, step := range []struct {
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		{http.MethodPut, "/users/1", paymentData{Amount: 100, PaymentID: 1}, http.StatusOK},
+		{http.MethodPut, "/users/1/debit", orderPaymentData{Amount: 30, OrderID: 5}, http.StatusOK},
+		// charged once: the second debit of the order is skipped.
+		{http.MethodPut, "/users/1/debit", orderPaymentData{Amount: 30, OrderID: 5}, http.StatusOK},
+		{http.MethodPut, "/users/1/refund", orderPaymentData{Amount: 30, OrderID: 5}, http.StatusOK},
+		{http.MethodPut, "/users/1/refund", orderPaymentData{Amount: 30, OrderID: 5}, http.StatusOK},
+		// never charged, so not refunded.
+		{http.MethodPut, "/users/1/refund", orderPaymentData{Amount: 7, OrderID: 6}, http.StatusOK},
+		{http.MethodPut, "/users/1/debit", orderPaymentData{Amount: 1000, OrderID: 6}, http.StatusUnprocessableEntity},
+		{http.MethodPut, "/users/1/transfer", transferData{ToUserID: 2, Amount: 20}, http.StatusOK},
+		{http.MethodPut, "/users/1/transfer", transferData{ToUserID: 2, Amount: 1000}, http.StatusUnprocessableEntity},
+		{http.MethodPut, "/users/1", paymentData{Amount: -10}, http.StatusOK},
+	} {
+		if status, body := send(t, srv, step.method, step.path, step.body); status != step.status {
+			t.Fatalf("%s %s %+v: got %d %s, want %d", step.method, step.path, step.body, status, body, step.status)
+		}
+	}
+
+	for id, want := range map[int64]int{1: 70, 2: 20} {
+		status, body := send(t, srv, http.MethodGet, fmt.Sprintf("/users/%d/balance", id), nil)
+		if status != http.StatusOK {
+			t.Fatalf("get balance of user %d: got %d %s", id, status, body)
+		}
+		var balance userBalance
+		if err := json.Unmarshal(body, &balance); err != nil {
+			t.Fatalf("decode balance of user %d: %v", id, err)
+		}
+		if !balance.Reconciled || balance.Amount != want || balance.LedgerAmount != want {
+			t.Errorf("balance of user %d: got %+v, want amount and ledger amount %d", id, balance, want)
+		}
+	}
+}
+
+// TestUserNotFound checks that the requests on a missing or deleted user fail
+// with 404.
+func TestUserNotFound(t *testing.T) {
+	srv := newTestServer(t)
+
+	if status, body := send(t, srv, http.MethodPost, "/users", user{UserName: "a", Account: "a"}); status != http.StatusCreated {
+		t.Fatalf("create user: got %d %s", status, body)
+	}
+	if status, body := send(t, srv, http.MethodDelete, "/users/1", nil); status >= http.StatusBadRequest {
+		t.Fatalf("delete user: got %d %s", status, body)
+	}
+
+	for _, req := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodGet, "/users/42", nil},
+		{http.MethodGet, "/users/1", nil},
+		{http.MethodDelete, "/users/1", nil},
+		{http.MethodPut, "/users/42", paymentData{Amount: 10}},
+		{http.MethodPut, "/users/42/debit", orderPaymentData{Amount: 10, OrderID: 1}},
+	} {
+		if status, body := send(t, srv, req.method, req.path, req.body); status != http.StatusNotFound {
+			t.Errorf("%s %s: got %d %s, want %d", req.method, req.path, status, body, http.StatusNotFound)
+		}
+	}
+}
+
+// TestRefundDeletedUser checks that the order a user paid is refunded once the
+// user is deleted, and that the ledger of the user can still be read, while
+// the user can no longer be charged.
+func TestRefundDeletedUser(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, step := range []struct {
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		{http.MethodPost, "/users", user{UserName: "a", Account: "a"}, http.StatusCreated},
+		{http.MethodPut, "/users/1", paymentData{Amount: 100, PaymentID: 1}, http.StatusOK},
+		{http.MethodPut, "/users/1/debit", orderPaymentData{Amount: 30, OrderID: 5, PaymentID: 2}, http.StatusOK},
+		{http.MethodDelete, "/users/1", nil, http.StatusNoContent},
+		{http.MethodPut, "/users/1/debit", orderPaymentData{Amount: 30, OrderID: 6, PaymentID: 3}, http.StatusNotFound},
+		{http.MethodPut, "/users/1/refund", orderPaymentData{Amount: 30, OrderID: 5, PaymentID: 4}, http.StatusOK},
+		{http.MethodGet, "/users/1/transactions?payment_id=4", nil, http.StatusOK},
+	} {
+		status, body := send(t, srv, step.method, step.path, step.body)
+		if status != step.status {
+			t.Fatalf("%s %s %+v: got %d %s, want %d", step.method, step.path, step.body, status, body, step.status)
+		}
+		if step.path == "/users/1/refund" {
+			var change balanceChange
+			if err := json.Unmarshal(body, &change); err != nil || !change.Applied {
+				t.Fatalf("refund of the deleted user: got %s, want it applied", body)
+			}
+		}
+		if step.method == http.MethodGet && !bytes.Contains(body, []byte(`"payment_id":4`)) {
+			t.Fatalf("transactions of the refund: got %s, want its ledger entries", body)
+		}
+	}
+}
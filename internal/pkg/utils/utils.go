@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,8 @@ import (
 	"time"
 
 	"github.com/go-playground/validator"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/config"
+	"github.com/naga2HPE/qt-test-application/internal/pkg/gerrors"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
@@ -46,6 +49,46 @@ func WriteErrorResponse(w http.ResponseWriter, statusCode int, err error) {
 	WriteResponse(w, statusCode, errResponse{err.Error()})
 }
 
+// WriteError writes err with the status matching its gerrors code, and 500 for
+// any other error.
+func WriteError(w http.ResponseWriter, err error) {
+	WriteResponse(w, HTTPStatus(err), errResponse{ErrorMessage(err)})
+}
+
+// ErrorMessage returns the message of err, without the stack trace of a gerrors error.
+func ErrorMessage(err error) string {
+	var gerr gerrors.Gerror
+	if errors.As(err, &gerr) {
+		return gerr.Message()
+	}
+	return err.Error()
+}
+
+// HTTPStatus returns the status code for the gerrors code of err.
+func HTTPStatus(err error) int {
+	var gerr gerrors.Gerror
+	if !errors.As(err, &gerr) {
+		return http.StatusInternalServerError
+	}
+
+	switch {
+	case gerr.EqualTag(gerrors.NotFound):
+		return http.StatusNotFound
+	case gerr.EqualTag(gerrors.BadRequest), gerr.EqualTag(gerrors.ValidationFailed):
+		return http.StatusBadRequest
+	case gerr.EqualTag(gerrors.Conflict), gerr.EqualTag(gerrors.InvalidTransition), gerr.EqualTag(gerrors.OutOfStock):
+		return http.StatusConflict
+	case gerr.EqualTag(gerrors.InsufficientBalance):
+		return http.StatusUnprocessableEntity
+	case gerr.EqualTag(gerrors.PaymentDeclined):
+		return http.StatusPaymentRequired
+	case gerr.EqualTag(gerrors.GatewayTimeout):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func WriteResponse(w http.ResponseWriter, statusCode int, response interface{}) {
 	w.WriteHeader(statusCode)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -53,6 +96,39 @@ func WriteResponse(w http.ResponseWriter, statusCode int, response interface{})
 	}
 }
 
+// ResponseError returns the error of a failed response from another service,
+// with the gerrors code matching its status so that WriteError passes the
+// status on.
+func ResponseError(resp *http.Response) error {
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read response error: %w", err)
+	}
+
+	message := string(bytes.TrimSpace(b))
+	var e errResponse
+	if err := json.Unmarshal(b, &e); err == nil && e.Message != "" {
+		message = e.Message
+	}
+
+	code := gerrors.InternalError
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		code = gerrors.BadRequest
+	case http.StatusNotFound:
+		code = gerrors.NotFound
+	case http.StatusConflict:
+		code = gerrors.Conflict
+	case http.StatusUnprocessableEntity:
+		code = gerrors.InsufficientBalance
+	case http.StatusPaymentRequired:
+		code = gerrors.PaymentDeclined
+	case http.StatusGatewayTimeout:
+		code = gerrors.GatewayTimeout
+	}
+	return gerrors.New(code, message)
+}
+
 func SendRequest(ctx context.Context, method string, url string, data []byte) (*http.Response, error) {
 	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(data))
 	if err != nil {
@@ -63,12 +139,35 @@ func SendRequest(ctx context.Context, method string, url string, data []byte) (*
 		// Wrap the Transport with one that starts a span and injects the span context
 		// into the outbound request headers.
 		Transport: otelhttp.NewTransport(http.DefaultTransport),
-		Timeout:   10 * time.Second,
+		Timeout:   config.RequestTimeout,
 	}
 
 	return client.Do(request)
 }
 
+// Detach returns a context with the values of ctx that is not cancelled with
+// it, for the work that must be done once started, e.g. recording the outcome
+// of a request whose client went away.
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -77,6 +176,7 @@ type responseWriter struct {
 func (rw *responseWriter) WriteHeader(statusCode int) {
 	log.Printf("status: %d", statusCode)
 	rw.statusCode = statusCode
+	rw.ResponseWriter.WriteHeader(statusCode)
 }
 
 func newResponseWriter(w http.ResponseWriter) *responseWriter {